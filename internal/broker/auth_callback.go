@@ -3,9 +3,12 @@ package broker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
 	"github.com/jr200-labs/nats-iam-broker/internal/tracing"
 	"github.com/nats-io/jwt/v2"
@@ -22,13 +25,16 @@ func newAuthCallbackWithWatcher(
 	m *metrics.Metrics,
 	nc *nats.Conn,
 	watcher *ConfigWatcher,
+	replay replayStore,
+	bucketRevocations *revocationList,
 ) AuthHandler {
 	return func(reqCtx context.Context, request *jwt.AuthorizationRequestClaims) (*jwt.UserClaims, nkeys.KeyPair, *UserAccountInfo, error) {
 		// Snapshot current state at request start. All operations in this
 		// request use this snapshot, ensuring consistency even if a reload
 		// happens mid-request.
 		state := watcher.State()
-		return handleAuthRequest(reqCtx, ctx, m, nc, state.config, state.configManager, state.idpVerifiers, state.auditSubject, request)
+		return handleAuthRequest(reqCtx, ctx, m, nc, state.config, state.configManager, state.idpVerifiers, state.auditSubject, replay,
+			[]*revocationList{state.revocations, bucketRevocations}, state.directory, request)
 	}
 }
 
@@ -41,6 +47,9 @@ func handleAuthRequest(
 	configManager *ConfigManager,
 	idpVerifiers []IdpAndJwtVerifier,
 	auditEventSubject string,
+	replay replayStore,
+	revocations []*revocationList,
+	directory *claimsDirectory,
 	request *jwt.AuthorizationRequestClaims,
 ) (*jwt.UserClaims, nkeys.KeyPair, *UserAccountInfo, error) {
 	requestStart := time.Now()
@@ -60,7 +69,9 @@ func handleAuthRequest(
 	// -- extract JWT --
 	_, extractSpan := getTracer().Start(reqCtx, "auth.callout.extract_jwt")
 	idpRawJwt, tokenReq := extractJWT(srvCtx, request)
-	if idpRawJwt == "" {
+	username, password, isPasswordGrant := passwordGrantCredentials(&request.ConnectOptions)
+	isPasswordGrant = isPasswordGrant && hasPasswordGrant(idpVerifiers)
+	if idpRawJwt == "" && !hasClientCertificate(request) {
 		extractSpan.SetStatus(codes.Error, "no valid JWT token found")
 		extractSpan.End()
 		recordResult(metrics.StatusError)
@@ -69,8 +80,21 @@ func handleAuthRequest(
 	extractSpan.End()
 
 	// -- verify IDP --
+	// Tokens take precedence; a client certificate is only used as the
+	// identity when the client sent no token.
 	verifyCtx, verifySpan := getTracer().Start(reqCtx, "auth.callout.verify_idp")
-	reqClaims, matchedVerifier, _, err := verifyAndEnrich(verifyCtx, m, idpRawJwt, tokenReq, idpVerifiers)
+	var reqClaims *IdpJwtClaims
+	var matchedVerifier *IdpAndJwtVerifier
+	var tokenRefreshed bool
+	var err error
+	switch {
+	case isPasswordGrant:
+		reqClaims, matchedVerifier, err = verifyPasswordGrant(verifyCtx, m, nc, config, username, password, idpVerifiers, request)
+	case idpRawJwt != "":
+		reqClaims, matchedVerifier, tokenRefreshed, err = verifyWithRefresh(verifyCtx, m, nc, config, idpRawJwt, tokenReq, idpVerifiers, request)
+	default:
+		reqClaims, matchedVerifier, err = verifyClientCertificate(m, request.TLS, idpVerifiers)
+	}
 	if err != nil {
 		verifySpan.SetStatus(codes.Error, err.Error())
 		verifySpan.RecordError(err)
@@ -85,12 +109,58 @@ func handleAuthRequest(
 	reqJwtClaims := reqClaims.toMap()
 	reqJwtClaims["client_id"] = request.ClientInformation.User        // Sentinel ID
 	reqJwtClaims["also_known_as"] = request.ClientInformation.NameTag // Sentinel name
+	bound, err := checkTokenBinding(reqJwtClaims, matchedVerifier.config.ProofOfPossession, request)
+	if err != nil {
+		zap.L().Warn("token binding rejected", zap.String("idp", matchedVerifier.config.Description), zap.Error(err))
+		recordResult(metrics.StatusDenied)
+		return nil, nil, nil, err
+	}
+	reqJwtClaims[tokenBoundClaim] = bound
+	if reqClaims.IdpClientID != "" {
+		reqJwtClaims[idpClientIDClaim] = reqClaims.IdpClientID
+	}
+	// Revocations are matched against the identity the IDP asserted, which
+	// transforms could otherwise rewrite.
+	revocationClaims := reqClaims
+	if transforms := matchedVerifier.verifier.transforms; len(transforms) > 0 {
+		revocationClaims = &IdpJwtClaims{}
+		revocationClaims.fromMap(reqJwtClaims, matchedVerifier.config.CustomMapping)
+		applyClaimTransforms(transforms, reqJwtClaims)
+	}
 	reqClaims.fromMap(reqJwtClaims, matchedVerifier.config.CustomMapping)
 
 	if srvCtx.Options.LogSensitive {
 		zap.L().Debug("reqClaims", zap.Any("claims", reqClaims.toMap()))
 	}
 
+	// -- revocation check --
+	if reason, revoked := checkRevocations(revocations, matchedVerifier.verifier.issuerURL, revocationClaims); revoked {
+		zap.L().Warn("identity revoked", zap.String("idp", matchedVerifier.config.Description), zap.String("reason", reason))
+		recordResult(metrics.StatusRevoked)
+		if m != nil {
+			m.RevokedRequests.WithLabelValues(matchedVerifier.config.Description, reason).Inc()
+		}
+		return nil, nil, nil, errIdentityRevoked
+	}
+
+	// -- enrich claims --
+	if stages := matchedVerifier.verifier.enrichment; len(stages) > 0 {
+		enrichCtx, enrichSpan := getTracer().Start(reqCtx, "auth.callout.enrich")
+		enriched, err := runEnrichment(enrichCtx, m, nc, matchedVerifier.config.Description, stages, reqClaims.toMap())
+		if err != nil {
+			enrichSpan.SetStatus(codes.Error, err.Error())
+			enrichSpan.RecordError(err)
+			enrichSpan.End()
+			recordResult(metrics.StatusError)
+			return nil, nil, nil, err
+		}
+		enrichSpan.End()
+		reqClaims.fromMap(enriched, matchedVerifier.config.CustomMapping)
+	}
+	if directory != nil {
+		reqClaims.fromMap(directory.apply(matchedVerifier.verifier.issuerURL, reqClaims.toMap()), matchedVerifier.config.CustomMapping)
+	}
+
 	// -- build claims --
 	_, buildSpan := getTracer().Start(reqCtx, "auth.callout.build_claims")
 	claims, signingKeyPair, userAccountInfo, resultStatus, err := buildUserClaims(srvCtx, config, configManager, reqClaims, matchedVerifier, request)
@@ -110,9 +180,29 @@ func handleAuthRequest(
 	buildSpan.SetAttributes(buildSpanAttrs...)
 	buildSpan.End()
 
+	// -- replay check --
+	// Only tokens presented by the client are counted; password grant and
+	// client certificate identities carry no reusable token.
+	if replay != nil && config.Replay.Enabled && idpRawJwt != "" && !isPasswordGrant {
+		expiresAt := time.Unix(reqClaims.Expiry, 0)
+		if reqClaims.Expiry == 0 {
+			expiresAt = time.Now().Add(DefaultMaxTokenLifetime)
+		}
+		key := replayKey(matchedVerifier.verifier.issuerURL, reqClaims.JwtID, idpRawJwt)
+		if err := checkReplay(reqCtx, replay, config.Replay.MaxUses, key, expiresAt); err != nil {
+			zap.L().Warn("token replay rejected", zap.String("idp", matchedVerifier.config.Description), zap.Error(err))
+			if errors.Is(err, errTokenReplayed) {
+				recordResult(metrics.StatusDenied)
+			} else {
+				recordResult(metrics.StatusError)
+			}
+			return nil, nil, nil, err
+		}
+	}
+
 	// -- audit --
 	auditCtx, auditSpan := getTracer().Start(reqCtx, "auth.callout.audit")
-	publishAuditEvent(auditCtx, nc, auditEventSubject, config, claims, request, reqClaims, matchedVerifier, userAccountInfo)
+	publishAuditEvent(auditCtx, nc, auditEventSubject, config, claims, request, reqClaims, matchedVerifier, userAccountInfo, tokenRefreshed)
 	auditSpan.End()
 
 	// Record result attributes on the parent span
@@ -153,11 +243,19 @@ func extractJWT(ctx *Context, request *jwt.AuthorizationRequestClaims) (string,
 	} else {
 		if err := json.Unmarshal([]byte(request.ConnectOptions.Password), &tokenReq); err == nil {
 			idpRawJwt = tokenReq.IDToken
-		} else {
+		} else if isCompactJWT(request.ConnectOptions.Password) {
+			// Any other raw password may be a user's credential for some
+			// IDP, so it is never sent to introspection endpoints.
 			idpRawJwt = request.ConnectOptions.Password
 		}
 	}
 
+	// Clients holding only an (opaque) access token send it without an
+	// id_token; it is verified through introspection.
+	if idpRawJwt == "" && tokenReq.AccessToken != "" {
+		idpRawJwt = tokenReq.AccessToken
+	}
+
 	return idpRawJwt, tokenReq
 }
 
@@ -182,6 +280,25 @@ func verifyAndEnrich(
 		m.IDPVerifyDuration.WithLabelValues(idpDesc).Observe(time.Since(verifyStart).Seconds())
 	}
 
+	if _, distributed := reqClaims.CustomClaims[claimNamesClaim]; distributed {
+		if resolver := matchedVerifier.verifier.distributedClaims; resolver != nil {
+			// The client's access token is only sent to claim sources when
+			// the ID token vouches for it through at_hash.
+			accessToken := tokenReq.AccessToken
+			if accessToken != "" && (verifiedIDToken == nil || verifiedIDToken.VerifyAccessToken(accessToken) != nil) {
+				zap.L().Debug("access token not tied to the id token, not using it for distributed claims", zap.String("idp", matchedVerifier.config.Description))
+				accessToken = ""
+			}
+			claims := reqClaims.toMap()
+			if err := resolver.resolve(ctx, m, claims, accessToken); err != nil {
+				return nil, nil, tokenReq, err
+			}
+			reqClaims.fromMap(claims, matchedVerifier.config.CustomMapping)
+		} else {
+			zap.L().Warn("token has distributed claims but distributed_claims is not enabled for its idp", zap.String("idp", matchedVerifier.config.Description))
+		}
+	}
+
 	if matchedVerifier.config.UserInfo.Enabled {
 		if tokenReq.AccessToken != "" {
 			userInfoCtx, userInfoCancel := context.WithTimeout(ctx, oidcTimeout)
@@ -204,6 +321,139 @@ func verifyAndEnrich(
 	return reqClaims, matchedVerifier, tokenReq, nil
 }
 
+// verifyWithRefresh verifies the client's token and, if it was rejected only
+// because the ID token has expired, redeems the client's refresh token at the
+// IDPs with refresh enabled and verifies the new ID token instead. It reports
+// whether a refreshed token was used. Every failed refresh, and every refresh
+// where the IDP rotated the refresh token, is audited.
+func verifyWithRefresh(
+	ctx context.Context,
+	m *metrics.Metrics,
+	nc *nats.Conn,
+	config *Config,
+	idpRawJwt string,
+	tokenReq TokenRequest,
+	idpVerifiers []IdpAndJwtVerifier,
+	request *jwt.AuthorizationRequestClaims,
+) (*IdpJwtClaims, *IdpAndJwtVerifier, bool, error) {
+	reqClaims, matchedVerifier, _, verifyErr := verifyAndEnrich(ctx, m, idpRawJwt, tokenReq, idpVerifiers)
+	var expiredErr *oidc.TokenExpiredError
+	if verifyErr == nil || tokenReq.RefreshToken == "" || !errors.As(verifyErr, &expiredErr) {
+		return reqClaims, matchedVerifier, false, verifyErr
+	}
+
+	candidates, err := routeVerifiers(idpRawJwt, idpVerifiers)
+	if err != nil {
+		return nil, nil, false, verifyErr
+	}
+
+	for _, item := range candidates {
+		if item.verifier.refresher == nil {
+			continue
+		}
+		idp := item.config.Description
+
+		refreshed, err := item.verifier.refresher.refresh(ctx, tokenReq.RefreshToken)
+		if err == nil {
+			err = checkRefreshedIdentity(idpRawJwt, refreshed.IDToken)
+		}
+		if err == nil {
+			reqClaims, matchedVerifier, _, err = verifyAndEnrich(ctx, m, refreshed.IDToken, refreshed, []IdpAndJwtVerifier{item})
+			if err == nil {
+				result := metrics.StatusSuccess
+				if isRotated(tokenReq.RefreshToken, refreshed) {
+					// The client cannot be given the new refresh token, so
+					// its own is now spent.
+					result = metrics.ResultRotated
+					zap.L().Warn("idp rotated the refresh token; the client's refresh token is spent, use non-rotating refresh tokens",
+						zap.String("idp", idp))
+					publishAttemptEvent(ctx, nc, tokenRefreshRotatedSubject(config), request, idp, result)
+				}
+				if m != nil {
+					m.TokenRefreshAttempts.WithLabelValues(idp, result).Inc()
+				}
+				zap.L().Debug("verified refreshed id token", zap.String("idp", idp))
+				return reqClaims, matchedVerifier, true, nil
+			}
+		}
+
+		result := tokenRefreshResult(err)
+		if m != nil {
+			m.TokenRefreshAttempts.WithLabelValues(idp, result).Inc()
+		}
+		zap.L().Warn("token refresh failed", zap.String("idp", idp), zap.String("result", result), zap.Error(err))
+		publishAttemptEvent(ctx, nc, tokenRefreshFailedSubject(config), request, idp, result)
+	}
+
+	return nil, nil, false, verifyErr
+}
+
+// verifyPasswordGrant exchanges the client's username and password for an ID
+// token at the IDP with password_grant enabled, and verifies it. Config
+// validation allows only one such IDP, so credentials never reach another.
+// A failed attempt is audited.
+func verifyPasswordGrant(
+	ctx context.Context,
+	m *metrics.Metrics,
+	nc *nats.Conn,
+	config *Config,
+	username string,
+	password string,
+	idpVerifiers []IdpAndJwtVerifier,
+	request *jwt.AuthorizationRequestClaims,
+) (*IdpJwtClaims, *IdpAndJwtVerifier, error) {
+	index := slices.IndexFunc(idpVerifiers, func(item IdpAndJwtVerifier) bool { return item.verifier.passwordGrant != nil })
+	if index < 0 {
+		return nil, nil, errors.New("no idp has password_grant enabled")
+	}
+	item := idpVerifiers[index]
+	idp := item.config.Description
+
+	tokenReq, err := item.verifier.passwordGrant.exchange(ctx, username, password)
+	if err == nil {
+		var reqClaims *IdpJwtClaims
+		var matchedVerifier *IdpAndJwtVerifier
+		reqClaims, matchedVerifier, _, err = verifyAndEnrich(ctx, m, tokenReq.IDToken, tokenReq, []IdpAndJwtVerifier{item})
+		if err == nil {
+			if m != nil {
+				m.PasswordGrantAttempts.WithLabelValues(idp, metrics.StatusSuccess).Inc()
+			}
+			return reqClaims, matchedVerifier, nil
+		}
+	}
+
+	result := passwordGrantResult(err)
+	if m != nil {
+		m.PasswordGrantAttempts.WithLabelValues(idp, result).Inc()
+	}
+	zap.L().Warn("password grant failed", zap.String("idp", idp), zap.String("result", result), zap.Error(err))
+	publishAttemptEvent(ctx, nc, passwordGrantFailedSubject(config), request, idp, result)
+	return nil, nil, fmt.Errorf("password grant failed: idp %s: %w", idp, err)
+}
+
+// verifyClientCertificate builds the request claims from the client's TLS
+// certificate, recording the same verification metrics as token verification.
+func verifyClientCertificate(
+	m *metrics.Metrics,
+	clientTLS *jwt.ClientTLS,
+	idpVerifiers []IdpAndJwtVerifier,
+) (*IdpJwtClaims, *IdpAndJwtVerifier, error) {
+	verifyStart := time.Now()
+	reqClaims, matchedVerifier, err := runCertificateVerification(clientTLS, idpVerifiers)
+	if err != nil {
+		if m != nil {
+			m.IDPVerifyTotal.WithLabelValues("unknown", metrics.StatusError).Inc()
+		}
+		return nil, nil, err
+	}
+	if m != nil {
+		idpDesc := matchedVerifier.config.Description
+		m.IDPVerifyTotal.WithLabelValues(idpDesc, metrics.StatusSuccess).Inc()
+		m.IDPVerifyDuration.WithLabelValues(idpDesc).Observe(time.Since(verifyStart).Seconds())
+	}
+	return reqClaims, matchedVerifier, nil
+}
+
 func buildUserClaims(
 	ctx *Context,
 	config *Config,
@@ -267,6 +517,64 @@ func buildUserClaims(
 	return claims, userAccountInfo.SigningNKey.KeyPair, userAccountInfo, "", nil
 }
 
+// passwordGrantFailedSubject returns the subject password grant failures are
+// audited on.
+func passwordGrantFailedSubject(config *Config) string {
+	return config.Service.Name + ".evt.audit.password_grant.failed"
+}
+
+// tokenRefreshFailedSubject returns the subject failed refresh token
+// redemptions are audited on.
+func tokenRefreshFailedSubject(config *Config) string {
+	return config.Service.Name + ".evt.audit.token_refresh.failed"
+}
+
+// tokenRefreshRotatedSubject returns the subject refreshes that rotated the
+// client's refresh token are audited on.
+func tokenRefreshRotatedSubject(config *Config) string {
+	return config.Service.Name + ".evt.audit.token_refresh.rotated"
+}
+
+// publishAttemptEvent publishes an audit event on subject for a failed
+// password grant or token refresh attempt, or a refresh that rotated the
+// refresh token. Credentials are never included.
+func publishAttemptEvent(
+	ctx context.Context,
+	nc *nats.Conn,
+	subject string,
+	request *jwt.AuthorizationRequestClaims,
+	idp string,
+	result string,
+) {
+	if nc == nil {
+		return
+	}
+
+	attemptEvent := map[string]interface{}{
+		"idp":           idp,
+		"result":        result,
+		"username":      request.ConnectOptions.Username,
+		"user_pub_nkey": request.UserNkey,
+		"client_host":   request.ClientInformation.Host,
+		"created_at":    time.Now().Format(time.RFC3339),
+	}
+
+	eventJSON, err := json.Marshal(attemptEvent)
+	if err != nil {
+		zap.L().Warn("failed to marshal attempt event", zap.String("subject", subject), zap.Error(err))
+		return
+	}
+
+	msg := &nats.Msg{
+		Subject: subject,
+		Data:    eventJSON,
+		Header:  tracing.InjectTraceContext(ctx, nil),
+	}
+	if err := nc.PublishMsg(msg); err != nil {
+		zap.L().Warn("failed to publish attempt event", zap.String("subject", subject), zap.Error(err))
+	}
+}
+
 func publishAuditEvent(
 	ctx context.Context,
 	nc *nats.Conn,
@@ -277,6 +585,7 @@ func publishAuditEvent(
 	reqClaims *IdpJwtClaims,
 	matchedVerifier *IdpAndJwtVerifier,
 	userAccountInfo *UserAccountInfo,
+	tokenRefreshed bool,
 ) {
 	signingKeyInfo, err := determineSigningKeyType(claims, userAccountInfo.SigningNKey.KeyPair, userAccountInfo)
 	if err != nil {
@@ -291,11 +600,13 @@ func publishAuditEvent(
 		"email":            reqClaims.Email,
 		"name":             reqClaims.Name,
 		"idp":              matchedVerifier.config.Description,
+		"idp_client_id":    reqClaims.IdpClientID,
 		"created_at":       time.Now().Format(time.RFC3339),
 		"expires_at":       time.Unix(claims.Expires, 0).Format(time.RFC3339),
 		"permissions":      &claims.Permissions,
 		"limits":           &claims.Limits,
 		"signing_account":  config.Service.Account.Name,
+		"token_refreshed":  tokenRefreshed,
 	}
 
 	if signingKeyInfo != nil {
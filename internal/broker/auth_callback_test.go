@@ -410,7 +410,7 @@ func TestPublishAuditEvent_TraceparentHeader(t *testing.T) {
 
 	// Publish with trace context
 	publishAuditEvent(ctx, nc, "test-svc.evt.audit.account.%s.user.%s.created",
-		f.config, claims, request, idpClaims, fakeIdpVerifier(), accountInfo)
+		f.config, claims, request, idpClaims, fakeIdpVerifier(), accountInfo, false)
 	require.NoError(t, nc.Flush())
 
 	// Receive and verify traceparent header
@@ -456,13 +456,21 @@ func TestExtractJWT(t *testing.T) {
 
 	t.Run("extracts JWT from password field when token is empty", func(t *testing.T) {
 		request := &jwt.AuthorizationRequestClaims{}
-		request.ConnectOptions.Password = "password-jwt-token"
+		request.ConnectOptions.Password = "header.payload.signature"
 
 		rawJwt, tokenReq := extractJWT(ctx, request)
-		assert.Equal(t, "password-jwt-token", rawJwt)
+		assert.Equal(t, "header.payload.signature", rawJwt)
 		assert.Empty(t, tokenReq.IDToken)
 	})
 
+	t.Run("ignores a plain password", func(t *testing.T) {
+		request := &jwt.AuthorizationRequestClaims{}
+		request.ConnectOptions.Password = "hunter2"
+
+		rawJwt, _ := extractJWT(ctx, request)
+		assert.Empty(t, rawJwt, "plain passwords must never be introspected")
+	})
+
 	t.Run("extracts JWT from JSON password field", func(t *testing.T) {
 		tokenJSON := `{"id_token":"pw-id-token","access_token":"pw-access"}`
 		request := &jwt.AuthorizationRequestClaims{}
@@ -473,6 +481,15 @@ func TestExtractJWT(t *testing.T) {
 		assert.Equal(t, "pw-access", tokenReq.AccessToken)
 	})
 
+	t.Run("falls back to access token without id token", func(t *testing.T) {
+		request := &jwt.AuthorizationRequestClaims{}
+		request.ConnectOptions.Token = `{"access_token":"opaque-access"}`
+
+		rawJwt, tokenReq := extractJWT(ctx, request)
+		assert.Equal(t, "opaque-access", rawJwt)
+		assert.Empty(t, tokenReq.IDToken)
+	})
+
 	t.Run("returns empty when no token or password", func(t *testing.T) {
 		request := &jwt.AuthorizationRequestClaims{}
 
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"strconv"
+	"strings"
+)
+
+// claimAtPath returns the claim at path. A path starting with '/' is a JSON
+// pointer (RFC 6901), e.g. "/resource_access/my.client/roles". Otherwise a
+// top-level claim named path is returned if there is one, so that claim names
+// containing dots such as "https://example.com/roles" keep working, and then
+// path is treated as dotted, e.g. "realm_access.roles". Both forms descend
+// into nested objects and, by index, into arrays.
+func claimAtPath(claims map[string]interface{}, path string) (interface{}, bool) {
+	if strings.HasPrefix(path, "/") {
+		return claimAtSegments(claims, jsonPointerSegments(path))
+	}
+	if value, ok := claims[path]; ok {
+		return value, true
+	}
+	if !strings.Contains(path, ".") {
+		return nil, false
+	}
+	return claimAtSegments(claims, strings.Split(path, "."))
+}
+
+// isClaimPath reports whether name addresses a nested claim rather than a
+// top-level one.
+func isClaimPath(name string) bool {
+	return strings.HasPrefix(name, "/") || strings.Contains(name, ".")
+}
+
+func claimAtSegments(claims map[string]interface{}, segments []string) (interface{}, bool) {
+	var current interface{} = claims
+	for _, segment := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// jsonPointerSegments splits a JSON pointer into its unescaped reference
+// tokens.
+func jsonPointerSegments(pointer string) []string {
+	segments := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+	}
+	return segments
+}
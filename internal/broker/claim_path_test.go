@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimAtPath(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":                       "user1",
+		"https://example.com/roles": []interface{}{"top"},
+		"a.b":                       "dotted-key",
+		"a":                         map[string]interface{}{"b": "nested"},
+		"realm_access":              map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+		"resource_access": map[string]interface{}{
+			"my.app": map[string]interface{}{"roles": []interface{}{"editor"}},
+		},
+		"odd/key~": "escaped",
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		expected interface{}
+		found    bool
+	}{
+		{name: "top-level claim", path: "sub", expected: "user1", found: true},
+		{name: "top-level claim with dots", path: "https://example.com/roles", expected: []interface{}{"top"}, found: true},
+		{name: "exact key wins over dotted path", path: "a.b", expected: "dotted-key", found: true},
+		{name: "dotted path", path: "realm_access.roles", expected: []interface{}{"admin", "user"}, found: true},
+		{name: "dotted path into array", path: "realm_access.roles.1", expected: "user", found: true},
+		{name: "json pointer", path: "/resource_access/my.app/roles", expected: []interface{}{"editor"}, found: true},
+		{name: "json pointer into array", path: "/realm_access/roles/0", expected: "admin", found: true},
+		{name: "json pointer escapes", path: "/odd~1key~0", expected: "escaped", found: true},
+		{name: "json pointer to nested map", path: "/a/b", expected: "nested", found: true},
+		{name: "missing top-level claim", path: "email", found: false},
+		{name: "missing nested claim", path: "realm_access.groups", found: false},
+		{name: "array index out of range", path: "realm_access.roles.5", found: false},
+		{name: "non-numeric array index", path: "/realm_access/roles/first", found: false},
+		{name: "descend into scalar", path: "sub.value", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, found := claimAtPath(claims, tt.path)
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -48,14 +49,41 @@ func setConfigParsePhase(phase string) {
 
 // Struct definitions
 type Config struct {
-	AppParams ConfigParams `yaml:"params"`
-	Server    Options      `yaml:"server"`
-	NATS      NATS         `yaml:"nats" validate:"required"`
-	Service   Service      `yaml:"service" validate:"required"`
-	Idp       []Idp        `yaml:"idp" validate:"required"`
-	Rbac      Rbac         `yaml:"rbac" validate:"required"`
+	AppParams  ConfigParams     `yaml:"params"`
+	Server     Options          `yaml:"server"`
+	NATS       NATS             `yaml:"nats" validate:"required"`
+	Service    Service          `yaml:"service" validate:"required"`
+	Idp        []Idp            `yaml:"idp" validate:"required"`
+	Rbac       Rbac             `yaml:"rbac" validate:"required"`
+	Replay     ReplayConfig     `yaml:"replay"`
+	Revocation RevocationConfig `yaml:"revocation"`
+	Directory  DirectoryConfig  `yaml:"directory"`
+
+	exprCache    *sync.Map `yaml:"-"` // shared compiled expr-lang expression cache
+	patternCache *sync.Map `yaml:"-"` // shared compiled match value pattern cache
+}
+
+// ReplayConfig limits how often the same IdP token can be redeemed. The
+// backend and bucket are fixed at startup; max_uses can be hot-reloaded.
+type ReplayConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	MaxUses int      `yaml:"max_uses"` // defaults to 1
+	Backend string   `yaml:"backend" validate:"omitempty,oneof=memory nats_kv"`
+	Bucket  string   `yaml:"bucket"` // nats_kv bucket, defaults to iam_broker_replay
+	TTL     Duration `yaml:"ttl"`    // nats_kv entry lifetime, defaults to 24h5m
+}
 
-	exprCache *sync.Map `yaml:"-"` // shared compiled expr-lang expression cache
+// RevocationConfig names the sources of revoked identities. The file is
+// reloaded when it changes; the bucket is fixed at startup.
+type RevocationConfig struct {
+	File   string `yaml:"file"`
+	Bucket string `yaml:"bucket"`
+}
+
+// DirectoryConfig names a local file of extra groups and attributes for
+// identities, reloaded when it changes.
+type DirectoryConfig struct {
+	File string `yaml:"file"`
 }
 
 type ConfigParams struct {
@@ -89,20 +117,251 @@ type ServiceAccount struct {
 }
 
 type Idp struct {
-	Description       string               `yaml:"description"`
-	IssuerURL         string               `yaml:"issuer_url" validate:"required"`
-	ClientID          string               `yaml:"client_id" validate:"required"`
-	ValidationSpec    IdpJwtValidationSpec `yaml:"validation"`
-	UserInfo          UserInfoConfig       `yaml:"user_info"`
-	TokenExpiryBounds DurationBounds       `yaml:"token_bounds"`
-	CustomMapping     map[string]string    `yaml:"custom_mapping"`
-	IgnoreSetupError  bool                 `yaml:"ignore_setup_error"`
-	MaxTokenLifetime  Duration             `yaml:"max_token_lifetime"`
-	ClockSkew         Duration             `yaml:"clock_skew"`
+	Description       string                  `yaml:"description"`
+	IssuerURL         string                  `yaml:"issuer_url"` // required unless client_cert is enabled, see validate
+	ClientID          string                  `yaml:"client_id"`  // required unless client_cert is enabled, see validate
+	ClientIDs         []string                `yaml:"client_ids"` // further accepted client ids, sharing one provider
+	ValidationSpec    IdpJwtValidationSpec    `yaml:"validation"`
+	UserInfo          UserInfoConfig          `yaml:"user_info"`
+	TokenExpiryBounds DurationBounds          `yaml:"token_bounds"`
+	CustomMapping     map[string]string       `yaml:"custom_mapping"`
+	IgnoreSetupError  bool                    `yaml:"ignore_setup_error"`
+	MaxTokenLifetime  Duration                `yaml:"max_token_lifetime"`
+	ClockSkew         Duration                `yaml:"clock_skew"`
+	Jwks              IdpJwksConfig           `yaml:"jwks"`
+	ClientSecret      string                  `yaml:"client_secret"`
+	Introspection     IntrospectionConfig     `yaml:"introspection"`
+	Spiffe            IdpSpiffeConfig         `yaml:"spiffe"`
+	ClientCert        IdpClientCertConfig     `yaml:"client_cert"`
+	PasswordGrant     PasswordGrantConfig     `yaml:"password_grant"`
+	Refresh           RefreshConfig           `yaml:"refresh"`
+	ProofOfPossession ProofOfPossessionConfig `yaml:"proof_of_possession"`
+	Enrichment        []EnrichmentConfig      `yaml:"enrichment"`
+	Transforms        []ClaimTransform        `yaml:"transforms"`
+	DistributedClaims DistributedClaimsConfig `yaml:"distributed_claims"`
+}
+
+// validate checks the fields required by the IDP's verification mode.
+func (idp *Idp) validate() error {
+	if idp.ClientCert.Enabled {
+		if idp.IssuerURL != "" || idp.Jwks.isStatic() || idp.Introspection.Enabled || idp.PasswordGrant.Enabled || idp.Refresh.Enabled {
+			return errors.New("client_cert cannot be combined with issuer_url, jwks, introspection, password_grant or refresh")
+		}
+		return nil
+	}
+
+	switch idp.UserInfo.CacheKey {
+	case "", UserInfoCacheKeyAccessToken, UserInfoCacheKeySubject:
+	default:
+		return fmt.Errorf("user_info.cache_key must be %q or %q", UserInfoCacheKeyAccessToken, UserInfoCacheKeySubject)
+	}
+
+	for _, alg := range idp.ValidationSpec.Algorithms {
+		if len(supportedJwsAlgorithms([]string{alg})) == 0 {
+			return fmt.Errorf("validation.algorithms: unsupported algorithm %q", alg)
+		}
+	}
+
+	var missing []string
+	if idp.IssuerURL == "" {
+		missing = append(missing, "Field 'IssuerURL' is required")
+	}
+	if len(idp.clientIDs()) == 0 {
+		missing = append(missing, "Field 'ClientID' is required")
+	}
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validatePasswordGrant allows the password grant on one IDP only, so a user's
+// credentials for one IDP are never sent to another.
+func (c *Config) validatePasswordGrant() error {
+	var enabled []string
+	for _, idp := range c.Idp {
+		if idp.PasswordGrant.Enabled {
+			enabled = append(enabled, idp.Description)
+		}
+	}
+	if len(enabled) > 1 {
+		return fmt.Errorf("password_grant can be enabled on one idp only, found %d: %s", len(enabled), strings.Join(enabled, ", "))
+	}
+	return nil
 }
 
+// validateReplay rejects a nats_kv replay TTL shorter than the time an IDP's
+// tokens can be accepted for: max_token_lifetime plus clock_skew. Counts
+// expire with the bucket, so a token outliving its count could be replayed.
+func (c *Config) validateReplay() error {
+	if !c.Replay.Enabled || c.Replay.Backend != ReplayBackendNatsKV {
+		return nil
+	}
+	ttl := c.Replay.kvTTL()
+	for _, idp := range c.Idp {
+		lifetime := idp.MaxTokenLifetime.Duration
+		if lifetime <= 0 {
+			lifetime = DefaultMaxTokenLifetime
+		}
+		skew := idp.ClockSkew.Duration
+		if skew <= 0 {
+			skew = DefaultClockSkew
+		}
+		if ttl < lifetime+skew {
+			return fmt.Errorf("replay.ttl %s is shorter than the max_token_lifetime plus clock_skew of idp %s (%s)", ttl, idp.Description, lifetime+skew)
+		}
+	}
+	return nil
+}
+
+// clientIDs returns the client ids the IDP accepts tokens for: client_id
+// followed by client_ids, without duplicates.
+func (idp *Idp) clientIDs() []string {
+	var ids []string
+	for _, id := range append([]string{idp.ClientID}, idp.ClientIDs...) {
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// primaryClientID returns the client id the broker authenticates to the IDP
+// with, for introspection, password grants and token refresh.
+func (idp *Idp) primaryClientID() string {
+	if ids := idp.clientIDs(); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// IdpJwksConfig configures an IDP's key set. When a file or inline keys are
+// given, tokens are verified offline: no discovery or JWKS requests are made,
+// and issuer_url is only used as the expected 'iss' claim. Otherwise the
+// intervals control how often the discovered jwks_uri is fetched again.
+type IdpJwksConfig struct {
+	File               string                   `yaml:"file"`
+	Keys               []map[string]interface{} `yaml:"keys"`
+	RefreshInterval    Duration                 `yaml:"refresh_interval"`     // defaults to 1h
+	MinRefreshInterval Duration                 `yaml:"min_refresh_interval"` // defaults to 30s
+}
+
+// isStatic reports whether the IDP should be verified against a static key set.
+func (j *IdpJwksConfig) isStatic() bool {
+	return j.File != "" || len(j.Keys) > 0
+}
+
+// PasswordGrantConfig enables the OAuth2 resource-owner password grant for an
+// IDP, so that clients which can only send a username and password are
+// authenticated by exchanging them for an ID token at the IDP.
+type PasswordGrantConfig struct {
+	Enabled       bool                   `yaml:"enabled"`
+	TokenEndpoint string                 `yaml:"token_endpoint"` // defaults to the discovered token_endpoint
+	Scopes        []string               `yaml:"scopes"`         // defaults to [openid]
+	RateLimit     PasswordGrantRateLimit `yaml:"rate_limit"`
+}
+
+// RefreshConfig enables redeeming a client's refresh_token when its ID token has
+// expired, so that reconnecting clients are not denied until they re-login.
+type RefreshConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	TokenEndpoint string `yaml:"token_endpoint"` // defaults to the discovered token_endpoint
+}
+
+// ProofOfPossessionConfig controls how tokens are bound to the NATS user nkey
+// of the connection presenting them.
+type ProofOfPossessionConfig struct {
+	Claim    string `yaml:"claim"`    // dotted claim path, defaults to cnf.nkey
+	Required bool   `yaml:"required"` // reject tokens that are not bound
+}
+
+// PasswordGrantRateLimit bounds password grant attempts per interval, both per
+// username and across all usernames.
+type PasswordGrantRateLimit struct {
+	PerUser  int      `yaml:"per_user"`
+	Global   int      `yaml:"global"`
+	Interval Duration `yaml:"interval"`
+}
+
+// IdpClientCertConfig configures an IDP that identifies clients by their TLS
+// client certificate instead of a token.
+type IdpClientCertConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	CAFile  string `yaml:"ca_file"` // optional; certificates must chain to a CA in this file
+}
+
+// IdpSpiffeConfig configures verification of SPIFFE JWT-SVIDs for an IDP whose
+// issuer_url is spiffe://<trust-domain>.
+type IdpSpiffeConfig struct {
+	BundleFile string `yaml:"bundle_file"` // SPIFFE trust bundle in JWKS format
+}
+
+// IntrospectionConfig enables RFC 7662 token introspection for an IDP, so that
+// opaque access tokens can be verified. The broker authenticates to the
+// endpoint with the IDP's client_id and client_secret.
+type IntrospectionConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Endpoint string `yaml:"endpoint"` // defaults to the discovered introspection_endpoint
+}
+
+// EnrichmentConfig adds claims from an external service to verified tokens,
+// before role bindings are evaluated. Exactly one source must be set.
+type EnrichmentConfig struct {
+	Name      string               `yaml:"name"` // labels metrics and logs, defaults to the source type
+	HTTP      HTTPEnrichmentConfig `yaml:"http"`
+	NATS      NATSEnrichmentConfig `yaml:"nats"`
+	Namespace string               `yaml:"namespace"` // claim to merge the response under; empty merges it into the claims
+	Timeout   Duration             `yaml:"timeout"`   // defaults to 5s
+	CacheTTL  Duration             `yaml:"cache_ttl"` // zero disables caching
+	CacheKey  string               `yaml:"cache_key"` // claim that responses are cached by, defaults to sub
+	FailOpen  bool                 `yaml:"fail_open"` // on failure, continue without the response instead of denying
+}
+
+// ClaimTransform rewrites a claim before role bindings are evaluated, e.g. to
+// normalise its case or split a delimited string into a list. Exactly one
+// operation must be set.
+type ClaimTransform struct {
+	Claim       string            `yaml:"claim"`        // claim name or path to read
+	Target      string            `yaml:"target"`       // claim to write, defaults to claim
+	Lowercase   bool              `yaml:"lowercase"`    // lowercases values
+	Split       string            `yaml:"split"`        // separator that turns a string into a list
+	Regex       string            `yaml:"regex"`        // keeps the first capture group, dropping values that do not match
+	Replace     *string           `yaml:"replace"`      // with regex, replaces matches instead of extracting
+	Prefix      string            `yaml:"prefix"`       // prepended to values
+	StripPrefix string            `yaml:"strip_prefix"` // removed from the start of values
+	Map         map[string]string `yaml:"map"`          // replaces listed values, keeping others
+}
+
+// DistributedClaimsConfig resolves the aggregated and distributed claims a
+// token references through _claim_names and _claim_sources.
+type DistributedClaimsConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedIssuers []string `yaml:"trusted_issuers"` // claims providers besides the IDP whose signed claims are accepted
+	Timeout        Duration `yaml:"timeout"`         // per claim source, defaults to 10s
+	Required       bool     `yaml:"required"`        // deny the request when a claim source cannot be resolved
+	AllowUnsigned  bool     `yaml:"allow_unsigned"`  // accept plain JSON from distributed claim endpoints
+}
+
+// HTTPEnrichmentConfig POSTs the verified claims as JSON to a webhook.
+type HTTPEnrichmentConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// NATSEnrichmentConfig sends the verified claims as a NATS request on Subject
+// over the broker's connection.
+type NATSEnrichmentConfig struct {
+	Subject string `yaml:"subject"`
+}
+
+// UserInfoConfig enables merging an IDP's UserInfo response into the token
+// claims. Responses are cached for cache_ttl when it is set.
 type UserInfoConfig struct {
-	Enabled bool `yaml:"enabled"`
+	Enabled    bool     `yaml:"enabled"`
+	CacheTTL   Duration `yaml:"cache_ttl"`   // zero disables the cache
+	StaleTTL   Duration `yaml:"stale_ttl"`   // how long past cache_ttl a response is served while refetched
+	CacheKey   string   `yaml:"cache_key"`   // access_token (default) or sub
+	MaxEntries int      `yaml:"max_entries"` // defaults to 10000
 }
 
 type IdpJwtValidationSpec struct {
@@ -111,6 +370,11 @@ type IdpJwtValidationSpec struct {
 	SkipAudienceValidation bool              `yaml:"skip_audience_validation"`
 	TokenExpiryBounds      DurationBounds    `yaml:"token_bounds"`
 	CustomClaimsMapping    map[string]string `yaml:"custom_claims_mapping"`
+	Algorithms             []string          `yaml:"algorithms"`  // allowed JOSE signing algorithms
+	EnforceNotBefore       bool              `yaml:"enforce_nbf"` // reject tokens before 'nbf', allowing for clock_skew
+	ValidateAzp            bool              `yaml:"validate_azp"`
+	Typ                    string            `yaml:"typ"`    // expected JOSE 'typ' header
+	Assert                 []string          `yaml:"assert"` // expr expressions that must all be true
 }
 
 type DurationBounds struct {
@@ -143,6 +407,7 @@ type ConfigManager struct {
 	validate      *validator.Validate
 	templateCache *templateCache
 	exprCache     *sync.Map // map[string]*vm.Program — compiled expr-lang expressions
+	patternCache  *sync.Map // map[string]*regexp.Regexp — compiled match value patterns
 }
 
 // ServerOptions returns the server options parsed from the YAML configuration.
@@ -203,6 +468,7 @@ func NewConfigManager(files []string) (*ConfigManager, error) {
 		validate:      v,
 		templateCache: tc,
 		exprCache:     &sync.Map{},
+		patternCache:  &sync.Map{},
 	}, nil
 }
 
@@ -283,6 +549,22 @@ func (cm *ConfigManager) GetConfig(mappings map[string]interface{}) (*Config, er
 		return nil, err
 	}
 
+	for i := range cfg.Idp {
+		if err := cfg.Idp[i].validate(); err != nil {
+			return nil, fmt.Errorf("idp[%d] (%s): %w", i, cfg.Idp[i].Description, err)
+		}
+	}
+	if err := cfg.validatePasswordGrant(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateReplay(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Rbac.compileMatchPatterns(cm.patternCache); err != nil {
+		return nil, err
+	}
+
 	// Discover and merge auto-accounts if auto_accounts_dir is set
 	if cfg.Rbac.AutoAccountsDir != "" {
 		discovered, err := cfg.Rbac.discoverAccounts()
@@ -317,8 +599,9 @@ func (cm *ConfigManager) GetConfig(mappings map[string]interface{}) (*Config, er
 		}
 	}
 
-	// Attach shared expression cache for role binding evaluation
+	// Attach shared expression and pattern caches for role binding evaluation
 	cfg.exprCache = cm.exprCache
+	cfg.patternCache = cm.patternCache
 
 	return &cfg, nil
 }
@@ -334,6 +617,43 @@ func (c *Config) natsOptions() []nats.Option {
 	return opts
 }
 
+// referencedFiles returns the files, other than the config files themselves,
+// whose contents feed into the live state (e.g. static JWKS files, SPIFFE
+// trust bundles, the revocation list and the directory). The config watcher
+// reloads when any of them change.
+func (c *Config) referencedFiles() []string {
+	var files []string
+	if c.Revocation.File != "" {
+		files = append(files, os.ExpandEnv(c.Revocation.File))
+	}
+	if c.Directory.File != "" {
+		files = append(files, os.ExpandEnv(c.Directory.File))
+	}
+	for _, idp := range c.Idp {
+		if idp.Jwks.File != "" {
+			files = append(files, os.ExpandEnv(idp.Jwks.File))
+		}
+		if idp.Spiffe.BundleFile != "" {
+			files = append(files, os.ExpandEnv(idp.Spiffe.BundleFile))
+		}
+		if idp.ClientCert.CAFile != "" {
+			files = append(files, os.ExpandEnv(idp.ClientCert.CAFile))
+		}
+	}
+	return files
+}
+
+// idpIndex returns the position of idp within c.Idp, or -1 if idp does not
+// point into this config.
+func (c *Config) idpIndex(idp *Idp) int {
+	for i := range c.Idp {
+		if &c.Idp[i] == idp {
+			return i
+		}
+	}
+	return -1
+}
+
 // serviceEncryptionXkey returns the encryption key pair for the service account.
 // Encryption is enabled when an xkey_seed is configured.
 func (c *Config) serviceEncryptionXkey() nkeys.KeyPair {
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
 
@@ -24,6 +26,9 @@ const (
 	StrategyBestMatch RoleBindingStrategy = "best_match"
 	// StrategyStrict requires all match criteria in a binding to succeed.
 	StrategyStrict RoleBindingStrategy = "strict"
+	// StrategyUnion merges the roles of every fully matching binding for the
+	// account of the first one.
+	StrategyUnion RoleBindingStrategy = "union"
 )
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface for RoleBindingStrategy.
@@ -35,7 +40,7 @@ func (rbs *RoleBindingStrategy) UnmarshalYAML(unmarshal func(interface{}) error)
 
 	strLower := strings.ToLower(str)
 	switch strLower {
-	case string(StrategyStrict), string(StrategyBestMatch):
+	case string(StrategyStrict), string(StrategyBestMatch), string(StrategyUnion):
 		*rbs = RoleBindingStrategy(strLower)
 		return nil
 	default:
@@ -132,6 +137,9 @@ type RoleBinding struct {
 	Roles          []string `yaml:"roles"`
 	TokenMaxExpiry Duration `yaml:"token_max_expiration"`
 	Match          []Match  `yaml:"match"`
+	// RequireBoundToken restricts the binding to tokens bound to the
+	// connecting nkey, see proof_of_possession.
+	RequireBoundToken bool `yaml:"require_bound_token"`
 }
 
 type Match struct {
@@ -141,6 +149,49 @@ type Match struct {
 	Permission string `yaml:"permission,omitempty"`
 	// Expression-based matching using expr-lang/expr
 	Expr string `yaml:"expr,omitempty"`
+	// ValueRegex and ValueGlob match the claim against a pattern instead of
+	// Value. Both must match the whole value.
+	ValueRegex string `yaml:"value_regex,omitempty"`
+	ValueGlob  string `yaml:"value_glob,omitempty"`
+	// Not negates the criterion: a binding is excluded when it holds, or
+	// when the claim it names is missing
+	Not bool `yaml:"not,omitempty"`
+}
+
+// expectedValue formats what a claim criterion expects, for logs.
+func (m Match) expectedValue() string {
+	switch {
+	case m.ValueRegex != "":
+		return "~" + m.ValueRegex
+	case m.ValueGlob != "":
+		return m.ValueGlob
+	default:
+		return m.Value
+	}
+}
+
+// isClaimCriterion reports whether the criterion matches a claim value rather
+// than an expression or permission.
+func (m Match) isClaimCriterion() bool {
+	return m.Expr == "" && m.Permission == ""
+}
+
+// describe formats the criterion for logs, as evaluateMatchCriterion does
+// for criteria that match.
+func (m Match) describe() string {
+	var description string
+	switch {
+	case m.Expr != "":
+		description = fmt.Sprintf("expr=%s", m.Expr)
+	case m.Permission != "":
+		description = fmt.Sprintf("permission=%s", m.Permission)
+	default:
+		description = fmt.Sprintf("%s=%s", m.Claim, m.expectedValue())
+	}
+	if m.Not {
+		return "not " + description
+	}
+	return description
 }
 
 type Role struct {
@@ -184,6 +235,81 @@ func loadOrCompileExpr(expression string, context map[string]interface{}, cache
 	return program, nil
 }
 
+// loadOrCompilePattern returns the compiled value_regex or value_glob of a
+// match criterion, using the cache if available. Patterns are anchored so
+// that they must match the whole claim value.
+func loadOrCompilePattern(match Match, cache *sync.Map) (*regexp.Regexp, error) {
+	var key, expression string
+	if match.ValueRegex != "" {
+		key = "regex:" + match.ValueRegex
+		expression = "^(?:" + match.ValueRegex + ")$"
+	} else {
+		key = "glob:" + match.ValueGlob
+		expression = globToRegex(match.ValueGlob)
+	}
+
+	if cache != nil {
+		if cached, ok := cache.Load(key); ok {
+			return cached.(*regexp.Regexp), nil
+		}
+	}
+
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.Store(key, pattern)
+	}
+	return pattern, nil
+}
+
+// globToRegex converts a glob, where '*' matches any run of characters and
+// '?' any single character, to an anchored regular expression.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// compileMatchPatterns compiles the value_regex and value_glob patterns of
+// every role binding into cache, so that a bad pattern fails loading the
+// config rather than never matching.
+func (r *Rbac) compileMatchPatterns(cache *sync.Map) error {
+	for i, rb := range r.RoleBinding {
+		for j, match := range rb.Match {
+			set := 0
+			for _, v := range []string{match.Value, match.ValueRegex, match.ValueGlob} {
+				if v != "" {
+					set++
+				}
+			}
+			if set > 1 {
+				return fmt.Errorf("rbac.role_binding[%d].match[%d]: only one of value, value_regex and value_glob may be set", i, j)
+			}
+			if match.ValueRegex == "" && match.ValueGlob == "" {
+				continue
+			}
+			if _, err := loadOrCompilePattern(match, cache); err != nil {
+				return fmt.Errorf("rbac.role_binding[%d].match[%d]: invalid pattern %q: %w", i, j, match.expectedValue(), err)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Config) lookupAccountInfo(userAccount string) (*UserAccountInfo, error) {
 	for _, acinfo := range c.Rbac.Accounts {
 		if acinfo.Name == userAccount {
@@ -196,29 +322,32 @@ func (c *Config) lookupAccountInfo(userAccount string) (*UserAccountInfo, error)
 
 // evaluateMatchCriterion checks if a single Match criterion is met by the context.
 // It returns true if matched, along with a string describing the match, otherwise false and an empty string.
-// exprCache is an optional cache of compiled expr-lang programs keyed by expression string.
-func evaluateMatchCriterion(match Match, context map[string]interface{}, bindingIndex int, exprCache *sync.Map) (matched bool, description string) {
+// An expression or pattern that cannot be compiled or evaluated returns an
+// error, so that callers can tell it apart from a criterion that does not hold.
+// exprCache is an optional cache of compiled expr-lang programs keyed by expression string,
+// and patternCache of compiled value_regex and value_glob patterns.
+func evaluateMatchCriterion(match Match, context map[string]interface{}, bindingIndex int, exprCache *sync.Map, patternCache *sync.Map) (matched bool, description string, err error) {
 	// Handle expression-based matching
 	if match.Expr != "" {
 		program, err := loadOrCompileExpr(match.Expr, context, exprCache)
 		if err != nil {
 			zap.L().Error("match-fail[expr]: compile error", zap.String("expr", match.Expr), zap.Int("binding_index", bindingIndex), zap.Error(err))
-			return false, ""
+			return false, "", err
 		}
 
 		result, err := expr.Run(program, context)
 		if err != nil {
 			zap.L().Debug("match-fail[expr]: eval error", zap.String("expr", match.Expr), zap.Int("binding_index", bindingIndex), zap.Error(err))
-			return false, ""
+			return false, "", err
 		}
 
 		if boolResult, ok := result.(bool); ok && boolResult {
 			zap.L().Debug("match-pass[expr]", zap.String("expr", match.Expr), zap.Int("binding_index", bindingIndex))
-			return true, fmt.Sprintf("expr=%s", match.Expr)
+			return true, fmt.Sprintf("expr=%s", match.Expr), nil
 		}
 
 		zap.L().Debug("match-fail[expr]", zap.String("expr", match.Expr), zap.Int("binding_index", bindingIndex))
-		return false, ""
+		return false, "", nil
 	}
 
 	// Handle permission-based matching
@@ -237,44 +366,61 @@ func evaluateMatchCriterion(match Match, context map[string]interface{}, binding
 
 		if isPermissionMatched {
 			zap.L().Debug("match-pass[permission]", zap.String("permission", match.Permission), zap.Int("binding_index", bindingIndex))
-			return true, fmt.Sprintf("permission=%s", match.Permission)
+			return true, fmt.Sprintf("permission=%s", match.Permission), nil
 		}
 
 		zap.L().Debug("match-fail[permission]", zap.String("permission", match.Permission), zap.Int("binding_index", bindingIndex))
-		return false, ""
+		return false, "", nil
 	}
 
 	// Handle regular claim-based matching
-	contextValue, exists := context[match.Claim]
+	contextValue, exists := claimAtPath(context, match.Claim)
 	if !exists {
 		zap.L().Debug("match-skip: claim key not found in context", zap.String("claim", match.Claim), zap.Int("binding_index", bindingIndex))
-		return false, "" // Claim doesn't exist, so it's not a match for this criterion
+		return false, "", nil // Claim doesn't exist, so it's not a match for this criterion
+	}
+
+	expected := match.expectedValue()
+	matchesValue := func(actual string) bool { return actual == match.Value }
+	if match.ValueRegex != "" || match.ValueGlob != "" {
+		pattern, err := loadOrCompilePattern(match, patternCache)
+		if err != nil {
+			zap.L().Error("match-fail[claim]: invalid pattern", zap.String("pattern", expected), zap.Int("binding_index", bindingIndex), zap.Error(err))
+			return false, "", err
+		}
+		matchesValue = pattern.MatchString
 	}
 
 	isClaimMatched := false
 	switch v := contextValue.(type) {
 	case string:
-		if v == match.Value {
+		if matchesValue(v) {
 			isClaimMatched = true
-			zap.L().Debug("match-pass[claim]", zap.String("claim", match.Claim), zap.String("expected", match.Value), zap.String("actual", v), zap.Int("binding_index", bindingIndex))
+			zap.L().Debug("match-pass[claim]", zap.String("claim", match.Claim), zap.String("expected", expected), zap.String("actual", v), zap.Int("binding_index", bindingIndex))
 		}
 	case []interface{}:
 		for _, val := range v {
-			if sv, ok := val.(string); ok && sv == match.Value {
+			if sv, ok := val.(string); ok && matchesValue(sv) {
 				isClaimMatched = true
-				zap.L().Debug("match-pass[claim]", zap.String("claim", match.Claim), zap.String("expected", match.Value), zap.Any("actual", val), zap.Int("binding_index", bindingIndex))
+				zap.L().Debug("match-pass[claim]", zap.String("claim", match.Claim), zap.String("expected", expected), zap.Any("actual", val), zap.Int("binding_index", bindingIndex))
 				break
 			}
 		}
 	case map[string]interface{}:
-		if _, ok := v[match.Value]; ok {
-			isClaimMatched = true
-			zap.L().Debug("match-pass[claim]: key exists in map", zap.String("claim", match.Claim), zap.String("key", match.Value), zap.Int("binding_index", bindingIndex))
+		for key := range v {
+			if matchesValue(key) {
+				isClaimMatched = true
+				zap.L().Debug("match-pass[claim]: key exists in map", zap.String("claim", match.Claim), zap.String("key", key), zap.Int("binding_index", bindingIndex))
+				break
+			}
 		}
 	case map[string]string:
-		if _, ok := v[match.Value]; ok {
-			isClaimMatched = true
-			zap.L().Debug("match-pass[claim]: key exists in map", zap.String("claim", match.Claim), zap.String("key", match.Value), zap.Int("binding_index", bindingIndex))
+		for key := range v {
+			if matchesValue(key) {
+				isClaimMatched = true
+				zap.L().Debug("match-pass[claim]: key exists in map", zap.String("claim", match.Claim), zap.String("key", key), zap.Int("binding_index", bindingIndex))
+				break
+			}
 		}
 	default:
 		zap.L().Debug("match-skip: unsupported type", zap.String("claim", match.Claim), zap.String("type", fmt.Sprintf("%T", v)), zap.Int("binding_index", bindingIndex))
@@ -282,11 +428,11 @@ func evaluateMatchCriterion(match Match, context map[string]interface{}, binding
 	}
 
 	if isClaimMatched {
-		return true, fmt.Sprintf("%s=%s", match.Claim, match.Value)
+		return true, fmt.Sprintf("%s=%s", match.Claim, expected), nil
 	}
 
-	zap.L().Debug("match-fail[claim]: value not found in context", zap.String("claim", match.Claim), zap.String("expected", match.Value), zap.Any("context_value", contextValue), zap.Int("binding_index", bindingIndex))
-	return false, ""
+	zap.L().Debug("match-fail[claim]: value not found in context", zap.String("claim", match.Claim), zap.String("expected", expected), zap.Any("context_value", contextValue), zap.Int("binding_index", bindingIndex))
+	return false, "", nil
 }
 
 func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt.Permissions, *jwt.Limits, Duration, error) {
@@ -305,15 +451,32 @@ func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt
 	var fallbackBinding *RoleBinding
 	var fallbackIndex int
 
+	// union: the fully matching bindings merged so far, all for the account
+	// of the first one in config order
+	var union *matchResult
+	var unionRoles []string
+
 	strategy := c.Rbac.RoleBindingMatchingStrategy
 	zap.L().Debug("Using role binding matching strategy", zap.String("strategy", string(strategy)))
 
 	for i, roleBinding := range c.Rbac.RoleBinding {
+		if !roleBinding.accepts(context) {
+			zap.L().Debug("match-skip: role binding requires a bound token", zap.Int("binding_index", i))
+			continue
+		}
+
 		currentMatches := 0
 		currentMatchedOn := []string{}
-		numMatchCriteria := len(roleBinding.Match)
+		// Negated criteria only exclude bindings, so they do not count
+		// towards the criteria a binding needs to match or its specificity.
+		numMatchCriteria := 0
+		for _, match := range roleBinding.Match {
+			if !match.Not {
+				numMatchCriteria++
+			}
+		}
 
-		if numMatchCriteria == 0 {
+		if len(roleBinding.Match) == 0 {
 			if fallbackBinding == nil {
 				fallbackBinding = &c.Rbac.RoleBinding[i]
 				fallbackIndex = i
@@ -324,8 +487,36 @@ func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt
 
 		// Evaluate all match criteria for this binding
 		bindingFullyMatched := true // Assume full match for strict initially
+		excluded := false
 		for _, match := range roleBinding.Match {
-			matched, description := evaluateMatchCriterion(match, context, i, c.exprCache)
+			matched, description, err := evaluateMatchCriterion(match, context, i, c.exprCache, c.patternCache)
+
+			if match.Not {
+				if err != nil {
+					// A negated criterion that cannot be evaluated fails closed
+					zap.L().Warn("match-exclude: negated criterion could not be evaluated", zap.String("criterion", match.describe()), zap.Int("binding_index", i), zap.Error(err))
+					excluded = true
+					break
+				}
+				if !matched && match.isClaimCriterion() {
+					if _, exists := claimAtPath(context, match.Claim); !exists {
+						// Without the claim there is no telling whether the
+						// negation holds, e.g. when an IDP omits an overlarge
+						// groups claim, so the binding is excluded
+						zap.L().Debug("match-exclude: negated criterion on a missing claim", zap.String("criterion", match.describe()), zap.Int("binding_index", i))
+						excluded = true
+						break
+					}
+				}
+				if matched {
+					// A negated criterion that holds rules the binding out under every strategy
+					zap.L().Debug("match-exclude: negated criterion holds", zap.String("criterion", match.describe()), zap.Int("binding_index", i))
+					excluded = true
+					break
+				}
+				currentMatchedOn = append(currentMatchedOn, match.describe())
+				continue
+			}
 
 			if matched {
 				currentMatches++
@@ -333,14 +524,18 @@ func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt
 			} else {
 				// If even one criterion fails, it's not a full match for strict strategy
 				bindingFullyMatched = false
-				// For strict matching, if one fails, we can stop checking this binding
-				if strategy == StrategyStrict {
+				// For strict and union matching, if one fails, we can stop checking this binding
+				if strategy == StrategyStrict || strategy == StrategyUnion {
 					currentMatches = -1 // Mark as failed for strict comparison later
 					break               // Stop checking criteria for this binding
 				}
 			}
 		}
 
+		if excluded {
+			continue
+		}
+
 		// --- Strategy-based selection ---
 
 		if strategy == StrategyStrict {
@@ -367,6 +562,34 @@ func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt
 			continue
 		}
 
+		if strategy == StrategyUnion {
+			if !bindingFullyMatched || currentMatches != numMatchCriteria {
+				continue
+			}
+			if union == nil {
+				union = &matchResult{account: roleBinding.Account}
+			} else if roleBinding.Account != union.account {
+				// The first matching binding in config order decides the account
+				zap.L().Debug("union: ignoring matching role binding for another account",
+					zap.Int("binding_index", i),
+					zap.String("role_binding_account", roleBinding.Account),
+					zap.String("selected_account", union.account))
+				continue
+			}
+			for _, role := range roleBinding.Roles {
+				if !slices.Contains(unionRoles, role) {
+					unionRoles = append(unionRoles, role)
+				}
+			}
+			// The shortest expiry set by any merged binding applies
+			if d := roleBinding.TokenMaxExpiry.Duration; d > 0 && (union.maxExpiry.Duration == 0 || d < union.maxExpiry.Duration) {
+				union.maxExpiry = roleBinding.TokenMaxExpiry
+			}
+			union.matches++
+			union.matchedOn = append(union.matchedOn, currentMatchedOn...)
+			continue
+		}
+
 		// best_match strategy
 		if currentMatches > 0 { // Only consider bindings with at least one match
 			updateBestMatch := false
@@ -419,6 +642,34 @@ func (c *Config) lookupUserAccount(context map[string]interface{}) (string, *jwt
 		return "", nil, nil, Duration{}, fmt.Errorf("no role-binding strictly matched idp token")
 	}
 
+	if strategy == StrategyUnion {
+		if union == nil {
+			if fallbackBinding != nil {
+				zap.L().Debug("no union match found, using fallback role binding",
+					zap.Int("binding_index", fallbackIndex),
+					zap.String("role_binding_account", fallbackBinding.Account))
+				permissions, limits, err := c.collateRoles(fallbackBinding.Roles)
+				if err != nil {
+					return "", nil, nil, Duration{}, err
+				}
+				return fallbackBinding.Account, permissions, limits, fallbackBinding.TokenMaxExpiry, nil
+			}
+			return "", nil, nil, Duration{}, fmt.Errorf("no role-binding matched idp token using union strategy")
+		}
+
+		zap.L().Debug("selected role bindings using union strategy",
+			zap.Int("bindings", union.matches),
+			zap.String("account", union.account),
+			zap.Strings("roles", unionRoles),
+			zap.Strings("matched_on", union.matchedOn))
+
+		permissions, limits, err := c.collateRoles(unionRoles)
+		if err != nil {
+			return "", nil, nil, Duration{}, err
+		}
+		return union.account, permissions, limits, union.maxExpiry, nil
+	}
+
 	// best_match: Check if any match was found
 	if bestMatch.matches == 0 {
 		if fallbackBinding != nil {
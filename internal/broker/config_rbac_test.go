@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
@@ -185,6 +186,20 @@ func TestLookupUserAccount_Strategies(t *testing.T) {
 			expectedAccount: "",
 			expectedRoles:   nil,
 		},
+		{
+			name:     "Strict: Nested Claim Path Match",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "realm_access.roles", Value: "admin"}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "/resource_access/my.app/roles", Value: "editor"}}},
+			},
+			context: map[string]interface{}{
+				"realm_access":    map[string]interface{}{"roles": []interface{}{"user"}},
+				"resource_access": map[string]interface{}{"my.app": map[string]interface{}{"roles": []interface{}{"editor"}}},
+			},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
 
 		// --- Best Match Strategy Tests ---
 		{
@@ -235,6 +250,30 @@ func TestLookupUserAccount_Strategies(t *testing.T) {
 			expectedRoles:   nil,
 		},
 
+		// --- Union Strategy Tests ---
+		{
+			name:     "Union: Roles Of All Full Matches Merged",
+			strategy: StrategyUnion,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+				{Account: "Acc1", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "ops"}}},
+				{Account: "Acc1", Roles: []string{"role-c"}, Match: []Match{{Claim: "groups", Value: "ops"}, {Claim: "sub", Value: "other"}}}, // Partial match, ignored
+			},
+			context:         map[string]interface{}{"sub": "user1", "groups": []interface{}{"dev", "ops"}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a", "role-b"},
+		},
+		{
+			name:     "Union: No Full Match",
+			strategy: StrategyUnion,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "sub", Value: "other"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "groups": []interface{}{"dev"}},
+			expectedAccount: "",
+			expectedRoles:   nil,
+		},
+
 		// --- Default Strategy Tests (should be best_match) ---
 		{
 			name:     "Default (BestMatch): Most Matches Wins",
@@ -270,6 +309,179 @@ func TestLookupUserAccount_Strategies(t *testing.T) {
 			expectedRoles:   []string{"role-b"},
 		},
 
+		// --- Negated Matching Tests ---
+		{
+			name:     "Strict: Negated Criterion Excludes Binding",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "groups", Value: "contractor", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"dev", "contractor"}},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "Strict: Negated Criterion Satisfied",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "groups", Value: "contractor", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"dev"}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a"},
+		},
+		{
+			name:     "Strict: Only Negated Criteria",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "contractor", Not: true}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "groups": []interface{}{"dev"}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a"},
+		},
+		{
+			name:     "Strict: Negated Criterion On Missing Claim Excludes Binding",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "sub", Value: "user1"}, {Claim: "groups", Value: "contractor", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "sub", Value: "user1"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1"},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "BestMatch: Negated Criterion On Missing Claim Excludes Higher Scoring Binding",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "sub", Value: "user1"}, {Claim: "email", Value: "user1@example.com"}, {Claim: "groups", Value: "contractor", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "sub", Value: "user1"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "email": "user1@example.com"},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "BestMatch: Negated Criterion Excludes Higher Scoring Binding",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "sub", Value: "user1"}, {Permission: "perm:vendor", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "groups": []interface{}{"dev"}, "permissions": []interface{}{"perm:vendor"}},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "BestMatch: Negated Criterion Does Not Add To Score",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Expr: "email endsWith '@vendor.com'", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "sub", Value: "user1"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "email": "user1@example.com", "groups": []interface{}{"dev"}},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "BestMatch: Only Negated Criteria Never Selected",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "contractor", Not: true}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"dev"}},
+			expectedAccount: "",
+			expectedRoles:   nil,
+		},
+		{
+			name:     "Strict: Negated Expr That Fails To Compile Excludes Binding",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Expr: "email endsWith", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+			},
+			context:         map[string]interface{}{"email": "user1@vendor.com", "groups": []interface{}{"dev"}},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "BestMatch: Negated Expr That Fails To Evaluate Excludes Binding",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}, {Claim: "sub", Value: "user1"}, {Expr: "int(tenant) == 7", Not: true}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "groups", Value: "dev"}}},
+			},
+			context:         map[string]interface{}{"sub": "user1", "tenant": "vendor", "groups": []interface{}{"dev"}},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+
+		// --- Pattern Matching Tests ---
+		{
+			name:     "Strict: Glob Matches Email",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "email", ValueGlob: "*@other.com"}}},
+				{Account: "Acc2", Roles: []string{"role-b"}, Match: []Match{{Claim: "email", ValueGlob: "*@ourcorp.com"}}},
+			},
+			context:         map[string]interface{}{"email": "alice@ourcorp.com"},
+			expectedAccount: "Acc2",
+			expectedRoles:   []string{"role-b"},
+		},
+		{
+			name:     "Strict: Glob Must Match Whole Value",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "email", ValueGlob: "*@ourcorp.com"}}},
+			},
+			context:         map[string]interface{}{"email": "alice@ourcorp.com.evil.org"},
+			expectedAccount: "",
+			expectedRoles:   nil,
+		},
+		{
+			name:     "Strict: Glob Matches Array Element",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", ValueGlob: "team-?"}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"staff", "team-a"}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a"},
+		},
+		{
+			name:     "Strict: Regex Matches Array Element",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", ValueRegex: "team-(ops|sre)"}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"team-dev", "team-sre"}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a"},
+		},
+		{
+			name:     "Strict: Regex Is Anchored",
+			strategy: StrategyStrict,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", ValueRegex: "admin"}}},
+			},
+			context:         map[string]interface{}{"groups": []interface{}{"not-admin"}},
+			expectedAccount: "",
+			expectedRoles:   nil,
+		},
+		{
+			name:     "BestMatch: Regex Matches Map Key",
+			strategy: StrategyBestMatch,
+			bindings: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "resource_access", ValueRegex: "nats-.*"}}},
+			},
+			context:         map[string]interface{}{"resource_access": map[string]interface{}{"nats-prod": map[string]interface{}{}}},
+			expectedAccount: "Acc1",
+			expectedRoles:   []string{"role-a"},
+		},
+
 		// --- Expr-based Matching Tests ---
 		{
 			name:     "Expr: Simple equality",
@@ -399,7 +611,7 @@ func TestLookupUserAccount_Strategies(t *testing.T) {
 			// Directly set the strategy in the config, simulating the result of UnmarshalYAML
 			// For empty/invalid strings, it should default to StrategyBestMatch
 			configStrategy := tt.strategy
-			if configStrategy == "" || (configStrategy != StrategyStrict && configStrategy != StrategyBestMatch) {
+			if configStrategy == "" || (configStrategy != StrategyStrict && configStrategy != StrategyBestMatch && configStrategy != StrategyUnion) {
 				configStrategy = StrategyBestMatch
 			}
 
@@ -443,6 +655,49 @@ func TestLookupUserAccount_Strategies(t *testing.T) {
 	}
 }
 
+func TestLookupUserAccount_Union(t *testing.T) {
+	roles := []Role{
+		{Name: "role-a", Permissions: Permissions{Pub: jwt.Permission{Allow: []string{"a.>"}}}},
+		{Name: "role-b", Permissions: Permissions{Pub: jwt.Permission{Allow: []string{"b.>"}}}},
+		{Name: "role-c", Permissions: Permissions{Pub: jwt.Permission{Allow: []string{"c.>"}}}},
+	}
+	cfg := &Config{
+		Rbac: Rbac{
+			RoleBindingMatchingStrategy: StrategyUnion,
+			RoleBinding: []RoleBinding{
+				{Account: "Acc1", Roles: []string{"role-a"}, Match: []Match{{Claim: "groups", Value: "dev"}}, TokenMaxExpiry: Duration{time.Hour}},
+				{Account: "Acc2", Roles: []string{"role-c"}, Match: []Match{{Claim: "groups", Value: "ops"}}},
+				{Account: "Acc1", Roles: []string{"role-a", "role-b"}, Match: []Match{{Claim: "groups", Value: "ops"}}, TokenMaxExpiry: Duration{10 * time.Minute}},
+				{Account: "Acc1", Roles: []string{"role-c"}, Match: []Match{{Claim: "groups", Value: "ops"}, {Claim: "groups", Value: "contractor", Not: true}}},
+				{Account: "Fallback", Roles: []string{"role-c"}},
+			},
+			Roles: roles,
+		},
+	}
+
+	t.Run("merges bindings for the first matching account", func(t *testing.T) {
+		account, perms, _, maxExpiry, err := cfg.lookupUserAccount(map[string]interface{}{"groups": []interface{}{"dev", "ops", "contractor"}})
+		require.NoError(t, err)
+		assert.Equal(t, "Acc1", account)
+		assert.ElementsMatch(t, jwt.StringList{"a.>", "b.>"}, perms.Pub.Allow, "role-c comes only from another account or an excluded binding")
+		assert.Equal(t, 10*time.Minute, maxExpiry.Duration, "shortest expiry of the merged bindings")
+	})
+
+	t.Run("first binding in config order decides the account", func(t *testing.T) {
+		account, perms, _, maxExpiry, err := cfg.lookupUserAccount(map[string]interface{}{"groups": []interface{}{"ops"}})
+		require.NoError(t, err)
+		assert.Equal(t, "Acc2", account)
+		assert.ElementsMatch(t, jwt.StringList{"c.>"}, perms.Pub.Allow)
+		assert.Zero(t, maxExpiry.Duration)
+	})
+
+	t.Run("fallback when nothing matches", func(t *testing.T) {
+		account, _, _, _, err := cfg.lookupUserAccount(map[string]interface{}{"groups": []interface{}{"sales"}})
+		require.NoError(t, err)
+		assert.Equal(t, "Fallback", account)
+	})
+}
+
 func TestLoadOrCompileExpr(t *testing.T) {
 	ctx := map[string]interface{}{"sub": "user1", "email": "user1@test.com"}
 
@@ -581,3 +836,38 @@ func TestLookupUserAccount_WithExprCache(t *testing.T) {
 		assert.Equal(t, "Acc1", account)
 	})
 }
+
+func TestCompileMatchPatterns(t *testing.T) {
+	t.Run("valid patterns are cached", func(t *testing.T) {
+		cache := &sync.Map{}
+		rbac := Rbac{RoleBinding: []RoleBinding{
+			{Match: []Match{{Claim: "email", ValueGlob: "*@ourcorp.com"}, {Claim: "groups", ValueRegex: "team-.+"}, {Claim: "sub", Value: "u1"}}},
+		}}
+		require.NoError(t, rbac.compileMatchPatterns(cache))
+
+		_, ok := cache.Load("glob:*@ourcorp.com")
+		assert.True(t, ok)
+		_, ok = cache.Load("regex:team-.+")
+		assert.True(t, ok)
+	})
+
+	t.Run("invalid regex fails", func(t *testing.T) {
+		rbac := Rbac{RoleBinding: []RoleBinding{{Match: []Match{{Claim: "groups", ValueRegex: "team-("}}}}}
+		err := rbac.compileMatchPatterns(&sync.Map{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rbac.role_binding[0].match[0]: invalid pattern")
+	})
+
+	t.Run("several values fail", func(t *testing.T) {
+		rbac := Rbac{RoleBinding: []RoleBinding{{Match: []Match{{Claim: "groups", Value: "a", ValueGlob: "a*"}}}}}
+		err := rbac.compileMatchPatterns(&sync.Map{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "only one of value, value_regex and value_glob")
+	})
+}
+
+func TestGlobToRegex(t *testing.T) {
+	assert.Equal(t, `^.*@ourcorp\.com$`, globToRegex("*@ourcorp.com"))
+	assert.Equal(t, `^team-.$`, globToRegex("team-?"))
+	assert.Equal(t, `^a\+b\(c\)$`, globToRegex("a+b(c)"))
+}
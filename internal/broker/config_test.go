@@ -3,6 +3,7 @@ package broker
 import (
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -165,6 +166,21 @@ rbac:
 
 		assert.Same(t, cfg1.exprCache, cfg2.exprCache, "all configs from same manager should share exprCache")
 	})
+
+	t.Run("GetConfig rejects invalid match patterns", func(t *testing.T) {
+		badFile, err := os.CreateTemp("", "bad-pattern-*.yaml")
+		require.NoError(t, err)
+		defer func() { _ = os.Remove(badFile.Name()) }()
+		_, err = badFile.WriteString(strings.Replace(baseConfig, `value: "{{.group}}"`, `value_regex: "team-("`, 1))
+		require.NoError(t, err)
+
+		cm, err := NewConfigManager([]string{badFile.Name()})
+		require.NoError(t, err)
+
+		_, err = cm.GetConfig(map[string]interface{}{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rbac.role_binding[1].match[0]: invalid pattern")
+	})
 }
 
 func TestConfigParsePhase_Atomic(t *testing.T) {
@@ -3,6 +3,7 @@ package broker
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,7 +21,10 @@ type LiveState struct {
 	config        *Config
 	configManager *ConfigManager
 	idpVerifiers  []IdpAndJwtVerifier
+	pendingIdps   []*Idp // IDPs that failed setup and are retried by the IdpSupervisor
 	auditSubject  string
+	revocations   *revocationList  // from revocation.file, nil if unset
+	directory     *claimsDirectory // from directory.file, nil if unset
 }
 
 // ConfigWatcher watches configuration files for changes and atomically
@@ -33,6 +37,7 @@ type ConfigWatcher struct {
 	reloadMu    sync.Mutex // serializes reload operations
 	stopCh      chan struct{}
 	watcher     *fsnotify.Watcher
+	supervisor  *IdpSupervisor // optional; notified of every reload
 }
 
 // NewConfigWatcher creates a ConfigWatcher with the given initial state.
@@ -68,26 +73,17 @@ func (cw *ConfigWatcher) Start() error {
 	}
 	cw.watcher = watcher
 
-	// Watch parent directories (not files) to handle symlink rotations
-	dirs := uniqueDirs(paths)
-	for _, dir := range dirs {
-		if err := watcher.Add(dir); err != nil {
-			_ = watcher.Close()
-			return fmt.Errorf("failed to watch directory %s: %w", dir, err)
-		}
-		zap.L().Debug("watching directory for config changes", zap.String("dir", dir))
-	}
+	// Also watch files referenced by the config (e.g. static JWKS files)
+	paths = append(paths, cw.State().config.referencedFiles()...)
 
 	// Build a set of absolute config file paths for filtering events
 	configPathSet := make(map[string]struct{}, len(paths))
-	for _, p := range paths {
-		abs, err := filepath.Abs(p)
-		if err != nil {
-			abs = p
-		}
-		configPathSet[abs] = struct{}{}
+	if err := cw.addWatchPaths(paths, configPathSet); err != nil {
+		_ = watcher.Close()
+		return err
 	}
 
+	dirs := uniqueDirs(paths)
 	go cw.watchLoop(configPathSet)
 
 	zap.L().Info("config file watcher started", zap.Int("files", len(paths)), zap.Int("directories", len(dirs)))
@@ -143,8 +139,34 @@ func (cw *ConfigWatcher) watchLoop(configPaths map[string]struct{}) {
 		case <-debounceCh:
 			debounceCh = nil
 			cw.doReload()
+
+			// A reload may reference new files (e.g. a different JWKS file)
+			if err := cw.addWatchPaths(cw.State().config.referencedFiles(), configPaths); err != nil {
+				zap.L().Error("failed to watch referenced files", zap.Error(err))
+			}
+		}
+	}
+}
+
+// addWatchPaths registers the parent directories of paths with the watcher
+// (not the files, to handle symlink rotations) and records each path in
+// configPaths so that events for it trigger a reload.
+func (cw *ConfigWatcher) addWatchPaths(paths []string, configPaths map[string]struct{}) error {
+	for _, dir := range uniqueDirs(paths) {
+		if err := cw.watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch directory %s: %w", dir, err)
+		}
+		zap.L().Debug("watching directory for config changes", zap.String("dir", dir))
+	}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
 		}
+		configPaths[abs] = struct{}{}
 	}
+	return nil
 }
 
 func (cw *ConfigWatcher) doReload() {
@@ -180,22 +202,49 @@ func (cw *ConfigWatcher) reload() error {
 			zap.String("new", newConfig.Service.CredsFile))
 	}
 
+	oldReplay, newReplay := current.config.Replay, newConfig.Replay
+	if oldReplay.Enabled != newReplay.Enabled || oldReplay.Backend != newReplay.Backend ||
+		oldReplay.Bucket != newReplay.Bucket || oldReplay.TTL != newReplay.TTL {
+		zap.L().Warn("replay cache settings changed; only replay.max_uses takes effect without a restart")
+	}
+	if current.config.Revocation.Bucket != newConfig.Revocation.Bucket {
+		zap.L().Warn("revocation.bucket changed; requires restart to take effect",
+			zap.String("old", current.config.Revocation.Bucket),
+			zap.String("new", newConfig.Revocation.Bucket))
+	}
+
 	// Recreate IDP verifiers with the new config
-	newVerifiers, err := NewIdpVerifiers(cw.ctx, newConfig)
+	newVerifiers, pendingIdps, err := newIdpVerifierSet(cw.ctx, newConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create IDP verifiers: %w", err)
 	}
 
+	revocations, err := loadRevocationFile(newConfig.Revocation.File)
+	if err != nil {
+		return err
+	}
+
+	directory, err := loadDirectoryFile(newConfig.Directory.File)
+	if err != nil {
+		return err
+	}
+
 	auditSubject := newConfig.Service.Name + ".evt.audit.account.%s.user.%s.created"
 
 	newState := &LiveState{
 		config:        newConfig,
 		configManager: newCM,
 		idpVerifiers:  newVerifiers,
+		pendingIdps:   pendingIdps,
 		auditSubject:  auditSubject,
+		revocations:   revocations,
+		directory:     directory,
 	}
 
 	cw.state.Store(newState)
+	if cw.supervisor != nil {
+		cw.supervisor.reset(newState)
+	}
 
 	zap.L().Info("configuration swapped",
 		zap.Int("idp_count", len(newConfig.Idp)),
@@ -205,6 +254,32 @@ func (cw *ConfigWatcher) reload() error {
 	return nil
 }
 
+// activateVerifier adds a verifier for a previously pending IDP to the live
+// state. It returns false without changing anything if the state has since
+// been replaced by a reload of a different configuration.
+func (cw *ConfigWatcher) activateVerifier(config *Config, item IdpAndJwtVerifier) bool {
+	cw.reloadMu.Lock()
+	defer cw.reloadMu.Unlock()
+
+	current := cw.state.Load()
+	if current.config != config {
+		return false
+	}
+
+	next := *current
+	next.idpVerifiers = append(slices.Clone(current.idpVerifiers), item)
+	// Keep verifiers in configuration order, which is the order they are tried in
+	slices.SortStableFunc(next.idpVerifiers, func(a, b IdpAndJwtVerifier) int {
+		return config.idpIndex(a.config) - config.idpIndex(b.config)
+	})
+	next.pendingIdps = slices.DeleteFunc(slices.Clone(current.pendingIdps), func(idp *Idp) bool {
+		return idp == item.config
+	})
+
+	cw.state.Store(&next)
+	return true
+}
+
 // resolveGlobPaths expands glob patterns to concrete file paths.
 func resolveGlobPaths(patterns []string) ([]string, error) {
 	var paths []string
@@ -1,9 +1,11 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -294,3 +296,44 @@ func TestIsRelevantEvent(t *testing.T) {
 		assert.False(t, isRelevantEvent(e, configPaths))
 	})
 }
+
+func TestConfigWatcher_ReloadRotatesStaticJwks(t *testing.T) {
+	tmpDir := t.TempDir()
+	jwksFile := filepath.Join(tmpDir, "jwks.json")
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	oldSigner := newTestSigner(t, "old")
+	oldSigner.writeJwks(t, jwksFile)
+
+	content := strings.Replace(fmt.Sprintf(testConfigTemplate, "jwks-test"),
+		"    ignore_setup_error: true\n",
+		fmt.Sprintf("    jwks:\n      file: %q\n", jwksFile), 1)
+	require.NoError(t, os.WriteFile(configFile, []byte(content), 0644))
+
+	initial := newTestLiveState(t, configFile)
+	assert.Equal(t, []string{jwksFile}, initial.config.referencedFiles())
+
+	ctx := NewServerContext(nil)
+	watcher := NewConfigWatcher(ctx, []string{configFile}, initial)
+	watcher.debounce = 100 * time.Millisecond
+	require.NoError(t, watcher.reload())
+
+	claims := map[string]interface{}{"iss": "https://test.idp", "aud": "test-client", "sub": "alice"}
+	_, _, _, err := runVerification(context.Background(), oldSigner.mint(t, claims), watcher.State().idpVerifiers)
+	require.NoError(t, err)
+
+	require.NoError(t, watcher.Start())
+	defer watcher.Stop()
+
+	// Rotate the key by rewriting only the JWKS file
+	newSigner := newTestSigner(t, "new")
+	newSigner.writeJwks(t, jwksFile)
+
+	assert.Eventually(t, func() bool {
+		_, _, _, err := runVerification(context.Background(), newSigner.mint(t, claims), watcher.State().idpVerifiers)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond, "verifiers should accept tokens signed with the rotated key")
+
+	_, _, _, err = runVerification(context.Background(), oldSigner.mint(t, claims), watcher.State().idpVerifiers)
+	assert.Error(t, err, "tokens signed with the retired key should be rejected")
+}
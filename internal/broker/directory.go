@@ -0,0 +1,192 @@
+package broker
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// directoryGroupSeparator separates groups within the groups column of a CSV
+// directory file.
+const directoryGroupSeparator = ";"
+
+// directoryEntry adds groups and attributes to every identity matching all of
+// its non-empty iss, sub and email fields.
+type directoryEntry struct {
+	Issuer     string                 `yaml:"iss"`
+	Subject    string                 `yaml:"sub"`
+	Email      string                 `yaml:"email"`
+	Groups     []string               `yaml:"groups"`
+	Attributes map[string]interface{} `yaml:"attributes"`
+}
+
+func (e directoryEntry) validate() error {
+	if e.Subject == "" && e.Email == "" {
+		return errors.New("directory entry needs at least one of sub or email")
+	}
+	// Subjects are only unique within an issuer, so sub alone would match
+	// the same subject at every IDP.
+	if e.Subject != "" && e.Issuer == "" {
+		return errors.New("directory entry with sub needs iss")
+	}
+	return nil
+}
+
+// matches reports whether the entry applies to the identity. Emails are
+// compared case-insensitively, and only match once the IDP has verified them:
+// an entry without iss would otherwise grant its groups to anyone able to
+// claim the address at any configured IDP.
+func (e directoryEntry) matches(issuer string, subject string, email string, emailVerified bool) bool {
+	return (e.Issuer == "" || e.Issuer == issuer) &&
+		(e.Subject == "" || e.Subject == subject) &&
+		(e.Email == "" || (emailVerified && strings.EqualFold(e.Email, email)))
+}
+
+// claimsDirectory holds the entries of a local directory file.
+type claimsDirectory struct {
+	entries []directoryEntry
+}
+
+// apply returns claims with the groups and attributes of every matching entry
+// merged in. Groups are appended to the 'groups' claim; attributes replace
+// claims of the same name, except for those set by the broker or verified
+// from the IDP.
+func (d *claimsDirectory) apply(issuer string, claims map[string]interface{}) map[string]interface{} {
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	var merged map[string]interface{}
+	for _, entry := range d.entries {
+		if !entry.matches(issuer, subject, email, emailVerified) {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]interface{}, len(claims))
+			for k, v := range claims {
+				merged[k] = v
+			}
+		}
+
+		if len(entry.Groups) > 0 {
+			groups := claimValues(merged["groups"])
+			for _, group := range entry.Groups {
+				if !slices.Contains(groups, interface{}(group)) {
+					groups = append(groups, group)
+				}
+			}
+			merged["groups"] = groups
+		}
+		for k, v := range entry.Attributes {
+			if !isProtectedClaim(k) {
+				merged[k] = v
+			}
+		}
+	}
+
+	if merged == nil {
+		return claims
+	}
+	return merged
+}
+
+// claimValues returns a single or multi-valued claim as a list.
+func claimValues(claim interface{}) []interface{} {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return slices.Clone(v)
+	case []string:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+		}
+		return values
+	default:
+		return []interface{}{v}
+	}
+}
+
+// loadDirectoryFile reads a directory file: a YAML or JSON list of entries,
+// or a CSV file when the extension is .csv. It returns nil if path is empty.
+func loadDirectoryFile(path string) (*claimsDirectory, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	path = os.ExpandEnv(path)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory file: %w", err)
+	}
+
+	var entries []directoryEntry
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		entries, err = parseDirectoryCSV(string(raw))
+	} else {
+		err = yaml.Unmarshal(raw, &entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing directory file %s: %w", path, err)
+	}
+
+	for i, entry := range entries {
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("directory file %s entry %d: %w", path, i, err)
+		}
+	}
+	return &claimsDirectory{entries: entries}, nil
+}
+
+// parseDirectoryCSV parses a CSV directory with a header row. The iss, sub,
+// email and groups columns fill the entry's fields, with groups separated by
+// semicolons; every other column is an attribute. Empty cells are ignored.
+func parseDirectoryCSV(raw string) ([]directoryEntry, error) {
+	records, err := csv.NewReader(strings.NewReader(raw)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	entries := make([]directoryEntry, 0, len(records)-1)
+	for _, record := range records[1:] {
+		var entry directoryEntry
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch column := strings.TrimSpace(header[i]); column {
+			case "iss":
+				entry.Issuer = value
+			case "sub":
+				entry.Subject = value
+			case "email":
+				entry.Email = value
+			case "groups":
+				for _, group := range strings.Split(value, directoryGroupSeparator) {
+					if group = strings.TrimSpace(group); group != "" {
+						entry.Groups = append(entry.Groups, group)
+					}
+				}
+			default:
+				if entry.Attributes == nil {
+					entry.Attributes = make(map[string]interface{})
+				}
+				entry.Attributes[column] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadDirectoryFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("unset", func(t *testing.T) {
+		directory, err := loadDirectoryFile("")
+		require.NoError(t, err)
+		assert.Nil(t, directory)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		path := filepath.Join(dir, "directory.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+- email: Alice@Example.com
+  groups: [nats-admins]
+  attributes:
+    team: payments
+    client_id: spoofed
+- iss: https://idp
+  sub: alice
+  groups: [nats-users, nats-admins]
+- iss: https://other
+  sub: alice
+  groups: [other-idp]
+`), 0644))
+
+		directory, err := loadDirectoryFile(path)
+		require.NoError(t, err)
+
+		claims := map[string]interface{}{"sub": "alice", "email": "alice@example.com", "email_verified": true, "groups": "staff", "client_id": "sentinel"}
+		merged := directory.apply("https://idp", claims)
+		assert.Equal(t, []interface{}{"staff", "nats-admins", "nats-users"}, merged["groups"])
+		assert.Equal(t, "payments", merged["team"])
+		assert.Equal(t, "sentinel", merged["client_id"], "broker claims should not be replaced")
+		assert.Equal(t, "staff", claims["groups"], "the input claims should not be modified")
+
+		unknown := map[string]interface{}{"sub": "bob"}
+		assert.Equal(t, unknown, directory.apply("https://idp", unknown))
+
+		unverified := map[string]interface{}{"sub": "mallory", "email": "alice@example.com", "email_verified": false}
+		assert.Equal(t, unverified, directory.apply("https://other", unverified), "unverified emails should not match")
+		unverified = map[string]interface{}{"sub": "mallory", "email": "alice@example.com"}
+		assert.Equal(t, unverified, directory.apply("https://other", unverified), "emails without email_verified should not match")
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		path := filepath.Join(dir, "directory.csv")
+		require.NoError(t, os.WriteFile(path, []byte("iss,sub,email,groups,cost_center\n,,bob@example.com,nats-users; ops,cc-42\nhttps://idp,carol,,nats-users,\n"), 0644))
+
+		directory, err := loadDirectoryFile(path)
+		require.NoError(t, err)
+
+		merged := directory.apply("https://idp", map[string]interface{}{"sub": "b-1", "email": "bob@example.com", "email_verified": true, "groups": []interface{}{"staff"}})
+		assert.Equal(t, []interface{}{"staff", "nats-users", "ops"}, merged["groups"])
+		assert.Equal(t, "cc-42", merged["cost_center"])
+
+		merged = directory.apply("https://idp", map[string]interface{}{"sub": "carol"})
+		assert.Equal(t, []interface{}{"nats-users"}, merged["groups"])
+		assert.NotContains(t, merged, "cost_center", "empty cells should be ignored")
+
+		other := map[string]interface{}{"sub": "carol"}
+		assert.Equal(t, other, directory.apply("https://other", other), "subjects should only match at their issuer")
+	})
+
+	t.Run("entry without identity", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("- iss: https://idp\n  groups: [admins]\n"), 0644))
+
+		_, err := loadDirectoryFile(path)
+		assert.ErrorContains(t, err, "entry 0")
+	})
+
+	t.Run("sub without iss", func(t *testing.T) {
+		path := filepath.Join(dir, "no-iss.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("- email: bob@example.com\n  groups: [users]\n- sub: alice\n  groups: [admins]\n"), 0644))
+
+		_, err := loadDirectoryFile(path)
+		assert.ErrorContains(t, err, "entry 1: directory entry with sub needs iss")
+	})
+}
@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// claimAssertion is a compiled validation.assert expression.
+type claimAssertion struct {
+	source  string
+	program *vm.Program
+}
+
+// compileAssertions compiles the boolean expressions an IDP's tokens must
+// satisfy. Claims missing from a token evaluate as nil rather than failing.
+func compileAssertions(expressions []string) ([]claimAssertion, error) {
+	assertions := make([]claimAssertion, 0, len(expressions))
+	for _, source := range expressions {
+		program, err := expr.Compile(source, expr.AsBool(), expr.AllowUndefinedVariables())
+		if err != nil {
+			return nil, fmt.Errorf("invalid validation.assert expression %q: %w", source, err)
+		}
+		assertions = append(assertions, claimAssertion{source: source, program: program})
+	}
+	return assertions, nil
+}
+
+// checkAssertions returns an error naming the first assertion that claims do
+// not satisfy.
+func checkAssertions(assertions []claimAssertion, claims *IdpJwtClaims) error {
+	if len(assertions) == 0 {
+		return nil
+	}
+
+	env := claims.toMap()
+	for _, assertion := range assertions {
+		result, err := expr.Run(assertion.program, env)
+		if err != nil {
+			return fmt.Errorf("idp token assertion %q failed: %w", assertion.source, err)
+		}
+		if ok, _ := result.(bool); !ok {
+			return fmt.Errorf("idp token does not satisfy assertion %q", assertion.source)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAssertions(t *testing.T) {
+	assertions, err := compileAssertions([]string{
+		`email_verified == true`,
+		`hd in ["example.com", "example.org"]`,
+		`acr matches "^urn:mace:incommon:iap:(silver|gold)$"`,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		claims  map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:   "all assertions hold",
+			claims: map[string]interface{}{"email_verified": true, "hd": "example.org", "acr": "urn:mace:incommon:iap:gold"},
+		},
+		{
+			name:    "unverified email",
+			claims:  map[string]interface{}{"email_verified": false, "hd": "example.org", "acr": "urn:mace:incommon:iap:gold"},
+			wantErr: `assertion "email_verified == true"`,
+		},
+		{
+			name:    "domain not allowed",
+			claims:  map[string]interface{}{"email_verified": true, "hd": "evil.example", "acr": "urn:mace:incommon:iap:gold"},
+			wantErr: `assertion "hd in [`,
+		},
+		{
+			name:    "missing claim",
+			claims:  map[string]interface{}{"email_verified": true, "hd": "example.com"},
+			wantErr: "acr matches",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := &IdpJwtClaims{}
+			claims.fromMap(tc.claims, nil)
+			err := checkAssertions(assertions, claims)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileAssertions_Invalid(t *testing.T) {
+	_, err := compileAssertions([]string{`email_verified ==`})
+	assert.ErrorContains(t, err, "invalid validation.assert expression")
+
+	_, err = newVerifierForIdp(NewServerContext(nil), &Idp{
+		ClientCert:     IdpClientCertConfig{Enabled: true},
+		ValidationSpec: IdpJwtValidationSpec{Assert: []string{`(`}},
+	})
+	assert.Error(t, err, "invalid assertions should fail idp setup")
+}
@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"go.uber.org/zap"
+)
+
+// clientCertVerifier builds identities from the TLS client certificate that a
+// NATS client presented when connecting.
+type clientCertVerifier struct {
+	roots *x509.CertPool // nil accepts any chain verified by the NATS server
+}
+
+// newClientCertVerifier creates a verifier for cfg, loading the CA bundle that
+// client certificates must chain to, if one is configured.
+func newClientCertVerifier(cfg IdpClientCertConfig) (*clientCertVerifier, error) {
+	if cfg.CAFile == "" {
+		return &clientCertVerifier{}, nil
+	}
+
+	raw, err := os.ReadFile(os.ExpandEnv(cfg.CAFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading client_cert.ca_file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in client_cert.ca_file %s", cfg.CAFile)
+	}
+	return &clientCertVerifier{roots: roots}, nil
+}
+
+// hasClientCertificate reports whether the connecting client presented a TLS
+// client certificate.
+func hasClientCertificate(request *jwt.AuthorizationRequestClaims) bool {
+	return request.TLS != nil && (len(request.TLS.VerifiedChains) > 0 || len(request.TLS.Certs) > 0)
+}
+
+// parsePEMCertificates decodes a list of PEM encoded certificates.
+func parsePEMCertificates(pems jwt.StringList) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(pems))
+	for _, p := range pems {
+		block, _ := pem.Decode([]byte(p))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("invalid pem certificate in client tls info")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// leafCertificate returns the client's leaf certificate once it has been
+// verified, either by the NATS server (verified_chains) or against the
+// configured CA bundle.
+func (c *clientCertVerifier) leafCertificate(clientTLS *jwt.ClientTLS) (*x509.Certificate, error) {
+	presented := clientTLS.Certs
+	for _, chain := range clientTLS.VerifiedChains {
+		if len(chain) > 0 {
+			presented = chain
+			break
+		}
+	}
+	if len(presented) == 0 {
+		return nil, errors.New("no client certificate presented")
+	}
+
+	certs, err := parsePEMCertificates(presented)
+	if err != nil {
+		return nil, err
+	}
+	leaf := certs[0]
+
+	if c.roots == nil {
+		if len(clientTLS.VerifiedChains) == 0 {
+			return nil, errors.New("client certificate was not verified by the nats server; configure client_cert.ca_file")
+		}
+		now := time.Now()
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return nil, errors.New("client certificate is not valid at the current time")
+		}
+		return leaf, nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("client certificate not trusted: %w", err)
+	}
+	return leaf, nil
+}
+
+// certificateClaims maps a client certificate to the claims used for role
+// binding and templates. The certificate's validity period becomes iat/exp, so
+// minted user JWTs never outlive the certificate.
+func certificateClaims(cert *x509.Certificate) map[string]interface{} {
+	toList := func(values []string) []interface{} {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		return list
+	}
+
+	uris := make([]string, len(cert.URIs))
+	for i, u := range cert.URIs {
+		uris[i] = u.String()
+	}
+
+	claims := map[string]interface{}{
+		"sub":              cert.Subject.CommonName,
+		"name":             cert.Subject.CommonName,
+		"iat":              float64(cert.NotBefore.Unix()),
+		"exp":              float64(cert.NotAfter.Unix()),
+		"cert_subject":     cert.Subject.String(),
+		"cert_common_name": cert.Subject.CommonName,
+		"cert_dns_names":   toList(cert.DNSNames),
+		"cert_uris":        toList(uris),
+		"cert_emails":      toList(cert.EmailAddresses),
+		"cert_issuer":      cert.Issuer.String(),
+		"cert_serial":      fmt.Sprintf("%x", cert.SerialNumber),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		claims["email"] = cert.EmailAddresses[0]
+	}
+	return claims
+}
+
+// runCertificateVerification builds claims from the client certificate using
+// the first IDP with client_cert enabled that trusts it, in configuration order.
+func runCertificateVerification(clientTLS *jwt.ClientTLS, items []IdpAndJwtVerifier) (*IdpJwtClaims, *IdpAndJwtVerifier, error) {
+	var certErrors []error
+	for _, item := range items {
+		if item.verifier.clientCert == nil {
+			continue
+		}
+
+		leaf, err := item.verifier.clientCert.leafCertificate(clientTLS)
+		if err != nil {
+			certErrors = append(certErrors, fmt.Errorf("idp %s: %w", item.config.Description, err))
+			zap.L().Debug("client certificate rejected, trying next idp", zap.String("idp", item.config.Description), zap.Error(err))
+			continue
+		}
+
+		reqClaims := &IdpJwtClaims{}
+		reqClaims.fromMap(certificateClaims(leaf), item.config.CustomMapping)
+
+		err = item.verifier.validateAgainstSpec(reqClaims, item.config.ValidationSpec)
+		if err != nil {
+			certErrors = append(certErrors, fmt.Errorf("idp %s validation: %w", item.config.Description, err))
+			zap.L().Debug("failed checks in idp validation", zap.Error(err))
+			continue
+		}
+
+		return reqClaims, &item, nil
+	}
+
+	if len(certErrors) == 0 {
+		return nil, nil, errors.New("no idp has client_cert enabled")
+	}
+	return nil, nil, fmt.Errorf("no idp accepted client certificate: %w", errors.Join(certErrors...))
+}
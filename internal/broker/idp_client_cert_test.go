@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues client certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns a PEM encoded client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestIdp_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		idp     Idp
+		wantErr string
+	}{
+		{name: "oidc", idp: Idp{IssuerURL: "https://idp", ClientID: "nats"}},
+		{name: "missing issuer and client", idp: Idp{}, wantErr: "Field 'IssuerURL' is required, Field 'ClientID' is required"},
+		{name: "client_ids only", idp: Idp{IssuerURL: "https://idp", ClientIDs: []string{"web", "cli"}}},
+		{name: "client cert", idp: Idp{ClientCert: IdpClientCertConfig{Enabled: true}}},
+		{name: "supported algorithms", idp: Idp{IssuerURL: "https://idp", ClientID: "nats", ValidationSpec: IdpJwtValidationSpec{Algorithms: []string{"RS256", "EdDSA"}}}},
+		{name: "misspelled algorithm", idp: Idp{IssuerURL: "https://idp", ClientID: "nats", ValidationSpec: IdpJwtValidationSpec{Algorithms: []string{"RS265"}}}, wantErr: `unsupported algorithm "RS265"`},
+		{name: "symmetric algorithm", idp: Idp{IssuerURL: "https://idp", ClientID: "nats", ValidationSpec: IdpJwtValidationSpec{Algorithms: []string{"HS256"}}}, wantErr: `unsupported algorithm "HS256"`},
+		{name: "client cert with issuer", idp: Idp{IssuerURL: "https://idp", ClientCert: IdpClientCertConfig{Enabled: true}}, wantErr: "cannot be combined"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.idp.validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertificateClaims(t *testing.T) {
+	ca := newTestCA(t, "Devices CA")
+	notAfter := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	spiffe, _ := url.Parse("spiffe://example.org/device/42")
+
+	certPEM := ca.issue(t, &x509.Certificate{
+		SerialNumber:   big.NewInt(0xbeef),
+		Subject:        pkix.Name{CommonName: "device-42", Organization: []string{"Acme"}},
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       notAfter,
+		DNSNames:       []string{"device-42.acme.internal"},
+		EmailAddresses: []string{"ops@acme.example"},
+		URIs:           []*url.URL{spiffe},
+	})
+	certs, err := parsePEMCertificates(jwt.StringList{certPEM})
+	require.NoError(t, err)
+
+	claims := &IdpJwtClaims{}
+	claims.fromMap(certificateClaims(certs[0]), nil)
+	assert.Equal(t, "device-42", claims.Subject)
+	assert.Equal(t, "ops@acme.example", claims.Email)
+	assert.Equal(t, notAfter.Unix(), claims.Expiry)
+
+	m := claims.toMap()
+	assert.Equal(t, "CN=device-42,O=Acme", m["cert_subject"])
+	assert.Equal(t, "CN=Devices CA", m["cert_issuer"])
+	assert.Equal(t, "beef", m["cert_serial"])
+	assert.Equal(t, []interface{}{"device-42.acme.internal"}, m["cert_dns_names"])
+	assert.Equal(t, []interface{}{"spiffe://example.org/device/42"}, m["cert_uris"])
+	assert.Equal(t, []interface{}{"ops@acme.example"}, m["cert_emails"])
+}
+
+func TestRunCertificateVerification(t *testing.T) {
+	ctx := NewServerContext(nil)
+	trusted := newTestCA(t, "Trusted CA")
+	other := newTestCA(t, "Other CA")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte(trusted.pem), 0644))
+
+	leaf := func(ca *testCA) string {
+		return ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "device-1"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		})
+	}
+
+	newItem := func(desc string, cfg IdpClientCertConfig) IdpAndJwtVerifier {
+		idp := &Idp{Description: desc, ClientCert: cfg}
+		verifier, err := newVerifierForIdp(ctx, idp)
+		require.NoError(t, err)
+		return IdpAndJwtVerifier{verifier, idp}
+	}
+
+	t.Run("chain verified by the nats server", func(t *testing.T) {
+		items := []IdpAndJwtVerifier{newItem("devices", IdpClientCertConfig{Enabled: true})}
+		clientTLS := &jwt.ClientTLS{VerifiedChains: []jwt.StringList{{leaf(other), other.pem}}}
+
+		claims, matched, err := runCertificateVerification(clientTLS, items)
+		require.NoError(t, err)
+		assert.Equal(t, "device-1", claims.Subject)
+		assert.Equal(t, "devices", matched.config.Description)
+	})
+
+	t.Run("unverified certificate without ca_file", func(t *testing.T) {
+		items := []IdpAndJwtVerifier{newItem("devices", IdpClientCertConfig{Enabled: true})}
+		_, _, err := runCertificateVerification(&jwt.ClientTLS{Certs: jwt.StringList{leaf(trusted)}}, items)
+		assert.ErrorContains(t, err, "not verified by the nats server")
+	})
+
+	t.Run("ca_file selects the issuing idp", func(t *testing.T) {
+		items := []IdpAndJwtVerifier{
+			newItem("pinned", IdpClientCertConfig{Enabled: true, CAFile: caFile}),
+		}
+
+		claims, matched, err := runCertificateVerification(&jwt.ClientTLS{Certs: jwt.StringList{leaf(trusted)}}, items)
+		require.NoError(t, err)
+		assert.Equal(t, "device-1", claims.Subject)
+		assert.Equal(t, "pinned", matched.config.Description)
+
+		_, _, err = runCertificateVerification(&jwt.ClientTLS{VerifiedChains: []jwt.StringList{{leaf(other), other.pem}}}, items)
+		assert.ErrorContains(t, err, "not trusted")
+	})
+
+	t.Run("token idps are skipped", func(t *testing.T) {
+		_, _, err := runCertificateVerification(&jwt.ClientTLS{Certs: jwt.StringList{leaf(trusted)}}, nil)
+		assert.EqualError(t, err, "no idp has client_cert enabled")
+	})
+}
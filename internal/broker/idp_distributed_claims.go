@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultDistributedClaimsTimeout bounds the fetch of each claim source.
+	defaultDistributedClaimsTimeout = 10 * time.Second
+
+	maxClaimSourceResponseSize = 1 << 20
+
+	claimNamesClaim   = "_claim_names"
+	claimSourcesClaim = "_claim_sources"
+)
+
+// distributedClaims resolves the aggregated and distributed claims of OIDC
+// Core 5.6.2. A token lists the claims it does not carry itself in
+// _claim_names, each naming a source in _claim_sources that either embeds a
+// signed JWT with the claims (aggregated) or gives an endpoint to fetch them
+// from (distributed).
+type distributedClaims struct {
+	idp            string
+	issuer         string
+	issuerVerifier *oidc.IDTokenVerifier // verifies claims signed by the IDP; nil without a key set
+	trustedIssuers []string
+	timeout        time.Duration
+	required       bool
+	allowUnsigned  bool
+	client         *http.Client
+
+	mu        sync.Mutex
+	verifiers map[string]*oidc.IDTokenVerifier // trusted issuers, discovered on first use
+}
+
+func newDistributedClaims(idp string, cfg DistributedClaimsConfig, verifier *IdpJwtVerifier) *distributedClaims {
+	d := &distributedClaims{
+		idp:            idp,
+		issuer:         verifier.issuerURL,
+		trustedIssuers: cfg.TrustedIssuers,
+		timeout:        cfg.Timeout.Duration,
+		required:       cfg.Required,
+		allowUnsigned:  cfg.AllowUnsigned,
+		client:         &http.Client{},
+		verifiers:      make(map[string]*oidc.IDTokenVerifier),
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultDistributedClaimsTimeout
+	}
+	if verifier.keySet != nil {
+		d.issuerVerifier = oidc.NewVerifier(verifier.issuerURL, verifier.keySet, claimsVerifierConfig(verifier.algorithms))
+	}
+	return d
+}
+
+// claimsVerifierConfig checks the signature and issuer of a claims JWT. Such
+// JWTs are not ID tokens, so they need neither an audience nor an expiry.
+func claimsVerifierConfig(algorithms []string) *oidc.Config {
+	return &oidc.Config{
+		SkipClientIDCheck:    true,
+		SkipExpiryCheck:      true,
+		SupportedSigningAlgs: algorithms,
+	}
+}
+
+// resolve merges the claims referenced by _claim_names into claims, fetching
+// distributed claims with the source's own access token or else accessToken,
+// which the caller must have tied to the ID token. Claims from a source about
+// a subject other than the token's are rejected. _claim_names and
+// _claim_sources are removed, since sources may carry access tokens. A source
+// that cannot be resolved is skipped with a warning, or fails the request
+// when the IDP requires distributed claims.
+func (d *distributedClaims) resolve(ctx context.Context, m *metrics.Metrics, claims map[string]interface{}, accessToken string) error {
+	subject, _ := claims["sub"].(string)
+	names, _ := claims[claimNamesClaim].(map[string]interface{})
+	sources, _ := claims[claimSourcesClaim].(map[string]interface{})
+	delete(claims, claimNamesClaim)
+	delete(claims, claimSourcesClaim)
+
+	resolved := make(map[string]map[string]interface{})
+	var errs []error
+	for name, source := range names {
+		sourceName, _ := source.(string)
+		values, seen := resolved[sourceName]
+		if !seen {
+			var err error
+			values, err = d.fetchSource(ctx, sources[sourceName], subject, accessToken)
+			if err != nil {
+				values = nil
+			}
+			resolved[sourceName] = values
+			if err != nil {
+				errs = append(errs, fmt.Errorf("claim source %q: %w", sourceName, err))
+				d.record(m, metrics.StatusError)
+				continue
+			}
+			d.record(m, metrics.StatusSuccess)
+		}
+		if value, ok := values[name]; ok {
+			claims[name] = value
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		if d.required {
+			return fmt.Errorf("failed to resolve distributed claims: %w", err)
+		}
+		zap.L().Warn("failed to resolve distributed claims, continuing without them", zap.String("idp", d.idp), zap.Error(err))
+	}
+	return nil
+}
+
+func (d *distributedClaims) record(m *metrics.Metrics, status string) {
+	if m != nil {
+		m.DistributedClaims.WithLabelValues(d.idp, status).Inc()
+	}
+}
+
+// fetchSource returns the claims of one _claim_sources entry, which must be
+// about subject.
+func (d *distributedClaims) fetchSource(ctx context.Context, source interface{}, subject string, accessToken string) (map[string]interface{}, error) {
+	entry, ok := source.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("missing from _claim_sources")
+	}
+	if token, _ := entry["JWT"].(string); token != "" {
+		values, err := d.verifyClaims(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		return values, checkClaimsSubject(values, subject, false)
+	}
+
+	endpoint, _ := entry["endpoint"].(string)
+	if endpoint == "" {
+		return nil, errors.New("has neither JWT nor endpoint")
+	}
+	if sourceToken, _ := entry["access_token"].(string); sourceToken != "" {
+		accessToken = sourceToken
+	}
+	if accessToken == "" {
+		return nil, errors.New("no access token to fetch distributed claims with")
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/jwt, application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxClaimSourceResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+
+	// OIDC requires a signed JWT. Plain JSON from the endpoint the IDP named
+	// in the signed token is only accepted when the IDP allows it, and must
+	// then name the subject.
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("{")) {
+		if !d.allowUnsigned {
+			return nil, errors.New("endpoint returned unsigned claims; set allow_unsigned to accept them")
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(body, &values); err != nil {
+			return nil, fmt.Errorf("invalid claims response: %w", err)
+		}
+		return values, checkClaimsSubject(values, subject, true)
+	}
+	values, err := d.verifyClaims(ctx, string(body))
+	if err != nil {
+		return nil, err
+	}
+	return values, checkClaimsSubject(values, subject, false)
+}
+
+// checkClaimsSubject rejects claims about a subject other than the token's.
+// Signed claims may leave out 'sub'; unsigned claims must carry it.
+func checkClaimsSubject(values map[string]interface{}, subject string, required bool) error {
+	sub, ok := values["sub"]
+	if !ok {
+		if required {
+			return errors.New("claims response has no 'sub'")
+		}
+		return nil
+	}
+	if s, _ := sub.(string); s == "" || s != subject {
+		return fmt.Errorf("claims response is for subject %q, expected %q", sub, subject)
+	}
+	return nil
+}
+
+// verifyClaims checks the signature of a claims JWT issued by the IDP or by a
+// trusted issuer and returns its claims.
+func (d *distributedClaims) verifyClaims(ctx context.Context, token string) (map[string]interface{}, error) {
+	routing, err := parseUnverifiedRouting(token)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := d.verifierFor(ctx, routing.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	verified, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims jwt: %w", err)
+	}
+	var values map[string]interface{}
+	if err := verified.Claims(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (d *distributedClaims) verifierFor(ctx context.Context, issuer string) (*oidc.IDTokenVerifier, error) {
+	if issuer == d.issuer && d.issuerVerifier != nil {
+		return d.issuerVerifier, nil
+	}
+	if !slices.Contains(d.trustedIssuers, issuer) {
+		return nil, fmt.Errorf("claims jwt issued by untrusted issuer %q", issuer)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if verifier, ok := d.verifiers[issuer]; ok {
+		return verifier, nil
+	}
+
+	discoverCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(discoverCtx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover claims issuer %q: %w", issuer, err)
+	}
+	verifier := provider.Verifier(claimsVerifierConfig(nil))
+	d.verifiers[issuer] = verifier
+	return verifier, nil
+}
@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const distributedTestIssuer = "https://idp.example.com"
+
+func newDistributedTestVerifier(t *testing.T, signer *testSigner, cfg DistributedClaimsConfig) *IdpJwtVerifier {
+	t.Helper()
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signer.key.PublicKey}}
+	verifier := NewStaticJwtVerifier(NewServerContext(nil), []string{"nats"}, distributedTestIssuer, keySet, 0, 0, nil)
+	verifier.distributedClaims = newDistributedClaims("test-idp", cfg, verifier)
+	return verifier
+}
+
+func TestDistributedClaims_Resolve(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	other := newTestSigner(t, "k2")
+
+	var gotAuth string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"sub": "alice", "groups": ["g1", "g2"], "unlisted": "ignored"}`))
+		case "/json-other-subject":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"sub": "bob", "groups": ["admins"]}`))
+		case "/jwt":
+			w.Header().Set("Content-Type", "application/jwt")
+			_, _ = w.Write([]byte(signer.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "sub": "alice", "department": "eng"})))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+
+	t.Run("aggregated claims signed by the idp", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true}).distributedClaims
+		claims := map[string]interface{}{
+			"sub":          "alice",
+			"_claim_names": map[string]interface{}{"roles": "src1"},
+			"_claim_sources": map[string]interface{}{
+				"src1": map[string]interface{}{"JWT": signer.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "roles": []interface{}{"admin"}, "exp": nil})},
+			},
+		}
+
+		require.NoError(t, d.resolve(context.Background(), nil, claims, ""))
+		assert.Equal(t, []interface{}{"admin"}, claims["roles"])
+		assert.NotContains(t, claims, "_claim_names")
+		assert.NotContains(t, claims, "_claim_sources")
+	})
+
+	t.Run("distributed claims from json and jwt endpoints", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, AllowUnsigned: true}).distributedClaims
+		claims := map[string]interface{}{
+			"sub":          "alice",
+			"_claim_names": map[string]interface{}{"groups": "src1", "department": "src2"},
+			"_claim_sources": map[string]interface{}{
+				"src1": map[string]interface{}{"endpoint": endpoint.URL + "/json"},
+				"src2": map[string]interface{}{"endpoint": endpoint.URL + "/jwt", "access_token": "source-token"},
+			},
+		}
+
+		require.NoError(t, d.resolve(context.Background(), nil, claims, "client-token"))
+		assert.Equal(t, []interface{}{"g1", "g2"}, claims["groups"])
+		assert.Equal(t, "eng", claims["department"])
+		assert.NotContains(t, claims, "unlisted")
+	})
+
+	t.Run("client access token is used without a source token", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, AllowUnsigned: true}).distributedClaims
+		claims := map[string]interface{}{
+			"sub":            "alice",
+			"_claim_names":   map[string]interface{}{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]interface{}{"endpoint": endpoint.URL + "/json"}},
+		}
+
+		require.NoError(t, d.resolve(context.Background(), nil, claims, "client-token"))
+		assert.Equal(t, "Bearer client-token", gotAuth)
+	})
+
+	t.Run("unsigned claims need opt-in", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, Required: true}).distributedClaims
+		claims := map[string]interface{}{
+			"sub":            "alice",
+			"_claim_names":   map[string]interface{}{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]interface{}{"endpoint": endpoint.URL + "/json"}},
+		}
+
+		err := d.resolve(context.Background(), nil, claims, "client-token")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unsigned claims")
+		assert.NotContains(t, claims, "groups")
+	})
+
+	t.Run("claims about another subject are rejected", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, Required: true, AllowUnsigned: true}).distributedClaims
+		newClaims := func(source map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"sub":            "alice",
+				"_claim_names":   map[string]interface{}{"groups": "src1"},
+				"_claim_sources": map[string]interface{}{"src1": source},
+			}
+		}
+
+		for _, source := range []map[string]interface{}{
+			{"endpoint": endpoint.URL + "/json-other-subject"},
+			{"JWT": signer.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "sub": "bob", "groups": []interface{}{"admins"}})},
+		} {
+			claims := newClaims(source)
+			err := d.resolve(context.Background(), nil, claims, "client-token")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), `subject "bob", expected "alice"`)
+			assert.NotContains(t, claims, "groups")
+		}
+	})
+
+	t.Run("failed sources are skipped unless required", func(t *testing.T) {
+		untrusted := other.mint(t, map[string]interface{}{"iss": "https://evil.example.com", "groups": []interface{}{"admins"}})
+		newClaims := func() map[string]interface{} {
+			return map[string]interface{}{
+				"_claim_names": map[string]interface{}{"groups": "src1", "roles": "src2", "email": "src3"},
+				"_claim_sources": map[string]interface{}{
+					"src1": map[string]interface{}{"JWT": untrusted},
+					"src2": map[string]interface{}{"endpoint": endpoint.URL + "/missing"},
+				},
+			}
+		}
+
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true}).distributedClaims
+		claims := newClaims()
+		require.NoError(t, d.resolve(context.Background(), nil, claims, "client-token"))
+		assert.Empty(t, claims)
+
+		d = newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, Required: true}).distributedClaims
+		err := d.resolve(context.Background(), nil, newClaims(), "client-token")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `untrusted issuer "https://evil.example.com"`)
+		assert.Contains(t, err.Error(), "status 404")
+		assert.Contains(t, err.Error(), "missing from _claim_sources")
+	})
+
+	t.Run("forged aggregated claims are rejected", func(t *testing.T) {
+		d := newDistributedTestVerifier(t, signer, DistributedClaimsConfig{Enabled: true, Required: true}).distributedClaims
+		claims := map[string]interface{}{
+			"_claim_names": map[string]interface{}{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{
+				"src1": map[string]interface{}{"JWT": other.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "groups": []interface{}{"admins"}})},
+			},
+		}
+
+		err := d.resolve(context.Background(), nil, claims, "")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid claims jwt")
+		assert.NotContains(t, claims, "groups")
+	})
+}
+
+func TestVerifyAndEnrich_DistributedClaims(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	idp := &Idp{IssuerURL: distributedTestIssuer, ClientID: "nats", DistributedClaims: DistributedClaimsConfig{Enabled: true}}
+	verifiers := []IdpAndJwtVerifier{{newDistributedTestVerifier(t, signer, idp.DistributedClaims), idp}}
+
+	token := signer.mint(t, map[string]interface{}{
+		"iss":          distributedTestIssuer,
+		"aud":          "nats",
+		"sub":          "alice",
+		"_claim_names": map[string]interface{}{"groups": "src1"},
+		"_claim_sources": map[string]interface{}{
+			"src1": map[string]interface{}{"JWT": signer.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "groups": []interface{}{"ops"}})},
+		},
+	})
+
+	claims, _, _, err := verifyAndEnrich(context.Background(), nil, token, TokenRequest{IDToken: token}, verifiers)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"ops"}, claims.Groups)
+	assert.NotContains(t, claims.CustomClaims, "_claim_sources")
+}
+
+func TestVerifyAndEnrich_DistributedClaimsAccessToken(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+
+	var gotAuth string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/jwt")
+		_, _ = w.Write([]byte(signer.mint(t, map[string]interface{}{"iss": distributedTestIssuer, "sub": "alice", "groups": []interface{}{"ops"}})))
+	}))
+	t.Cleanup(endpoint.Close)
+
+	idp := &Idp{IssuerURL: distributedTestIssuer, ClientID: "nats", DistributedClaims: DistributedClaimsConfig{Enabled: true}}
+	verifiers := []IdpAndJwtVerifier{{newDistributedTestVerifier(t, signer, idp.DistributedClaims), idp}}
+
+	// at_hash of "alice-access-token" for RS256: the left half of its
+	// SHA-256, base64url encoded.
+	sum := sha256.Sum256([]byte("alice-access-token"))
+	atHash := base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	token := signer.mint(t, map[string]interface{}{
+		"iss":            distributedTestIssuer,
+		"aud":            "nats",
+		"sub":            "alice",
+		"at_hash":        atHash,
+		"_claim_names":   map[string]interface{}{"groups": "src1"},
+		"_claim_sources": map[string]interface{}{"src1": map[string]interface{}{"endpoint": endpoint.URL}},
+	})
+
+	t.Run("access token tied to the id token", func(t *testing.T) {
+		gotAuth = ""
+		claims, _, _, err := verifyAndEnrich(context.Background(), nil, token, TokenRequest{IDToken: token, AccessToken: "alice-access-token"}, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer alice-access-token", gotAuth)
+		assert.Equal(t, []interface{}{"ops"}, claims.Groups)
+	})
+
+	t.Run("another user's access token is not sent", func(t *testing.T) {
+		gotAuth = ""
+		claims, _, _, err := verifyAndEnrich(context.Background(), nil, token, TokenRequest{IDToken: token, AccessToken: "bob-access-token"}, verifiers)
+		require.NoError(t, err)
+		assert.Empty(t, gotAuth)
+		assert.Empty(t, claims.Groups)
+	})
+}
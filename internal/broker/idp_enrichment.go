@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEnrichmentTimeout  = 5 * time.Second
+	defaultEnrichmentCacheKey = "sub"
+
+	maxEnrichmentResponseSize = 1 << 20
+)
+
+// brokerClaims are set by the broker rather than the IDP and cannot be
+// replaced by an enrichment response.
+var brokerClaims = []string{"client_id", "also_known_as", tokenBoundClaim, idpClientIDClaim}
+
+// verifiedClaims are asserted by the IDP and decide the identity, lifetime
+// and replay key of the minted user, so enrichment cannot replace them either.
+var verifiedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "email_verified"}
+
+// isProtectedClaim reports whether claim is set by the broker or verified
+// from the IDP, and so must not be replaced by enrichment.
+func isProtectedClaim(claim string) bool {
+	return slices.Contains(brokerClaims, claim) || slices.Contains(verifiedClaims, claim)
+}
+
+var errEnrichmentFailed = errors.New("claims enrichment failed")
+
+// enrichmentSource looks up additional claims for a JSON encoded claims
+// document. nc is the broker's NATS connection.
+type enrichmentSource interface {
+	kind() string
+	lookup(ctx context.Context, nc *nats.Conn, claims []byte) ([]byte, error)
+}
+
+// enrichmentStage merges the response of a source into the verified claims.
+type enrichmentStage struct {
+	name      string
+	source    enrichmentSource
+	namespace string
+	timeout   time.Duration
+	cacheTTL  time.Duration
+	cacheKey  string
+	cache     *ttlCache[map[string]interface{}]
+	failOpen  bool
+}
+
+// newEnrichmentStages creates the enrichment stages of an IDP, in order.
+func newEnrichmentStages(cfgs []EnrichmentConfig) ([]*enrichmentStage, error) {
+	var stages []*enrichmentStage
+	for i, cfg := range cfgs {
+		var source enrichmentSource
+		switch {
+		case cfg.HTTP.URL != "" && cfg.NATS.Subject != "":
+			return nil, fmt.Errorf("enrichment[%d] sets both http.url and nats.subject", i)
+		case cfg.HTTP.URL != "":
+			source = newHTTPEnrichment(cfg.HTTP)
+		case cfg.NATS.Subject != "":
+			source = newNATSEnrichment(cfg.NATS)
+		default:
+			return nil, fmt.Errorf("enrichment[%d] has no source; set http.url or nats.subject", i)
+		}
+		if isProtectedClaim(cfg.Namespace) {
+			return nil, fmt.Errorf("enrichment[%d] namespace %q would replace a verified or broker claim", i, cfg.Namespace)
+		}
+
+		stage := &enrichmentStage{
+			name:      cfg.Name,
+			source:    source,
+			namespace: cfg.Namespace,
+			timeout:   cfg.Timeout.Duration,
+			cacheTTL:  cfg.CacheTTL.Duration,
+			cacheKey:  cfg.CacheKey,
+			failOpen:  cfg.FailOpen,
+		}
+		if stage.name == "" {
+			stage.name = source.kind()
+		}
+		if stage.timeout <= 0 {
+			stage.timeout = defaultEnrichmentTimeout
+		}
+		if stage.cacheKey == "" {
+			stage.cacheKey = defaultEnrichmentCacheKey
+		}
+		if stage.cacheTTL > 0 {
+			stage.cache = newTTLCache[map[string]interface{}](0)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// runEnrichment applies the stages to claims in order, each seeing the claims
+// merged by the previous ones, and returns the enriched claims. A failing
+// stage is skipped if it fails open, and otherwise denies the request.
+func runEnrichment(ctx context.Context, m *metrics.Metrics, nc *nats.Conn, idp string, stages []*enrichmentStage, claims map[string]interface{}) (map[string]interface{}, error) {
+	for _, stage := range stages {
+		response, err := stage.run(ctx, m, nc, idp, claims)
+		if err != nil {
+			if stage.failOpen {
+				zap.L().Warn("claims enrichment failed, continuing without it", zap.String("idp", idp), zap.String("enrichment", stage.name), zap.Error(err))
+				continue
+			}
+			zap.L().Warn("claims enrichment failed", zap.String("idp", idp), zap.String("enrichment", stage.name), zap.Error(err))
+			return nil, fmt.Errorf("%w: %s: %w", errEnrichmentFailed, stage.name, err)
+		}
+		claims = stage.merge(claims, response)
+	}
+	return claims, nil
+}
+
+// run returns the source's response for claims, from the cache if possible.
+func (s *enrichmentStage) run(ctx context.Context, m *metrics.Metrics, nc *nats.Conn, idp string, claims map[string]interface{}) (map[string]interface{}, error) {
+	record := func(result string) {
+		if m != nil {
+			m.EnrichmentRequests.WithLabelValues(idp, s.name, result).Inc()
+		}
+	}
+
+	var cacheKey string
+	if s.cache != nil {
+		if value, ok := claims[s.cacheKey]; ok && value != "" {
+			cacheKey = fmt.Sprint(value)
+			if response, ok := s.cache.get(cacheKey); ok {
+				record(metrics.ResultHit)
+				return response, nil
+			}
+		}
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		record(metrics.StatusError)
+		return nil, err
+	}
+
+	lookupCtx, lookupCancel := context.WithTimeout(ctx, s.timeout)
+	defer lookupCancel()
+
+	lookupStart := time.Now()
+	raw, err := s.source.lookup(lookupCtx, nc, body)
+	if m != nil {
+		m.EnrichmentDuration.WithLabelValues(idp, s.name).Observe(time.Since(lookupStart).Seconds())
+	}
+	if err != nil {
+		record(metrics.StatusError)
+		return nil, err
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		record(metrics.StatusError)
+		return nil, fmt.Errorf("response is not a json object: %w", err)
+	}
+	record(metrics.StatusSuccess)
+
+	if cacheKey != "" {
+		s.cache.set(cacheKey, response, time.Now().Add(s.cacheTTL))
+	}
+	return response, nil
+}
+
+// merge returns claims with response added under the stage's namespace, or
+// replacing top-level claims when no namespace is set. Claims set by the
+// broker or verified from the IDP are never replaced.
+func (s *enrichmentStage) merge(claims map[string]interface{}, response map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(claims)+len(response))
+	for k, v := range claims {
+		merged[k] = v
+	}
+
+	if s.namespace != "" {
+		merged[s.namespace] = response
+	} else {
+		for k, v := range response {
+			merged[k] = v
+		}
+	}
+	for _, protected := range [][]string{brokerClaims, verifiedClaims} {
+		for _, k := range protected {
+			if v, ok := claims[k]; ok {
+				merged[k] = v
+			} else {
+				delete(merged, k)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+)
+
+// httpEnrichment POSTs the claims to a webhook and returns its JSON response.
+type httpEnrichment struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPEnrichment(cfg HTTPEnrichmentConfig) *httpEnrichment {
+	return &httpEnrichment{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  &http.Client{},
+	}
+}
+
+func (h *httpEnrichment) kind() string {
+	return "http"
+}
+
+func (h *httpEnrichment) lookup(ctx context.Context, _ *nats.Conn, claims []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(claims))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("enrichment endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxEnrichmentResponseSize))
+}
@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/tracing"
+	"github.com/nats-io/nats.go"
+)
+
+// natsServiceErrorHeader is set on replies by services built with the NATS
+// micro framework when a request fails.
+const natsServiceErrorHeader = "Nats-Service-Error"
+
+// natsEnrichment sends the claims as a request on a NATS subject, over the
+// broker's own connection, and returns the JSON reply.
+type natsEnrichment struct {
+	subject string
+}
+
+func newNATSEnrichment(cfg NATSEnrichmentConfig) *natsEnrichment {
+	return &natsEnrichment{subject: cfg.Subject}
+}
+
+func (n *natsEnrichment) kind() string {
+	return "nats"
+}
+
+func (n *natsEnrichment) lookup(ctx context.Context, nc *nats.Conn, claims []byte) ([]byte, error) {
+	if nc == nil {
+		return nil, errors.New("no nats connection")
+	}
+
+	msg := &nats.Msg{
+		Subject: n.subject,
+		Data:    claims,
+		Header:  tracing.InjectTraceContext(ctx, nil),
+	}
+	reply, err := nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("request on %q failed: %w", n.subject, err)
+	}
+	if serviceErr := reply.Header.Get(natsServiceErrorHeader); serviceErr != "" {
+		return nil, fmt.Errorf("service on %q returned error: %s", n.subject, serviceErr)
+	}
+	return reply.Data, nil
+}
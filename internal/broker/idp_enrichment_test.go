@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/tracing"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEnrichmentServer serves project memberships for the posted subject and
+// counts the requests it receives.
+func newEnrichmentServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var claims map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&claims); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"projects":  []string{claims["sub"].(string) + "-project"},
+			"client_id": "spoofed",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestRunEnrichment(t *testing.T) {
+	server, calls := newEnrichmentServer(t)
+	headers := map[string]string{"Authorization": "Bearer s3cret"}
+	claims := map[string]interface{}{"sub": "alice", "client_id": "sentinel"}
+
+	t.Run("merged into claims", func(t *testing.T) {
+		stages, err := newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: server.URL, Headers: headers}}})
+		require.NoError(t, err)
+		assert.Equal(t, "http", stages[0].name)
+
+		enriched, err := runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"alice-project"}, enriched["projects"])
+		assert.Equal(t, "sentinel", enriched["client_id"], "broker claims should not be replaced")
+		assert.NotContains(t, claims, "projects", "the input claims should not be modified")
+	})
+
+	t.Run("merged under a namespace", func(t *testing.T) {
+		stages, err := newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: server.URL, Headers: headers}, Namespace: "directory"}})
+		require.NoError(t, err)
+
+		enriched, err := runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+		require.NoError(t, err)
+		assert.NotContains(t, enriched, "projects")
+		assert.Equal(t, []interface{}{"alice-project"}, enriched["directory"].(map[string]interface{})["projects"])
+		assert.Equal(t, "sentinel", enriched["client_id"])
+	})
+
+	t.Run("cached by subject", func(t *testing.T) {
+		stages, err := newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: server.URL, Headers: headers}, CacheTTL: Duration{time.Minute}}})
+		require.NoError(t, err)
+
+		before := calls.Load()
+		for range 3 {
+			_, err := runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, before+1, calls.Load())
+
+		enriched, err := runEnrichment(context.Background(), nil, nil, "sso", stages, map[string]interface{}{"sub": "bob"})
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"bob-project"}, enriched["projects"])
+		assert.Equal(t, before+2, calls.Load())
+	})
+
+	t.Run("fail closed", func(t *testing.T) {
+		stages, err := newEnrichmentStages([]EnrichmentConfig{{Name: "projects", HTTP: HTTPEnrichmentConfig{URL: server.URL}}})
+		require.NoError(t, err)
+
+		_, err = runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+		assert.ErrorIs(t, err, errEnrichmentFailed)
+		assert.ErrorContains(t, err, "projects: enrichment endpoint returned 401 Unauthorized")
+	})
+
+	t.Run("fail open", func(t *testing.T) {
+		stages, err := newEnrichmentStages([]EnrichmentConfig{
+			{HTTP: HTTPEnrichmentConfig{URL: server.URL}, FailOpen: true},
+			{HTTP: HTTPEnrichmentConfig{URL: server.URL, Headers: headers}, Namespace: "directory"},
+		})
+		require.NoError(t, err)
+
+		enriched, err := runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+		require.NoError(t, err)
+		assert.NotContains(t, enriched, "projects")
+		assert.Contains(t, enriched, "directory", "later stages should still run")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			<-release
+		}))
+		t.Cleanup(slow.Close)
+		t.Cleanup(func() { close(release) })
+
+		stages, err := newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: slow.URL}, Timeout: Duration{50 * time.Millisecond}}})
+		require.NoError(t, err)
+
+		_, err = runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestRunEnrichment_VerifiedClaimsProtected(t *testing.T) {
+	idpExpiry := time.Now().Add(10 * time.Minute).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"exp":            time.Now().Add(30 * 24 * time.Hour).Unix(),
+			"sub":            "mallory",
+			"jti":            "forged",
+			"email_verified": true,
+			"projects":       []string{"p1"},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	stages, err := newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: server.URL}}})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "alice", "exp": float64(idpExpiry), "jti": "jti-1"}
+	enriched, err := runEnrichment(context.Background(), nil, nil, "sso", stages, claims)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"p1"}, enriched["projects"])
+	assert.Equal(t, "alice", enriched["sub"])
+	assert.Equal(t, "jti-1", enriched["jti"])
+	assert.NotContains(t, enriched, "email_verified", "verified claims missing from the token must not be added")
+
+	reqClaims := &IdpJwtClaims{}
+	reqClaims.fromMap(enriched, nil)
+	cfg := &Config{NATS: NATS{TokenExpiryBounds: DurationBounds{Max: Duration{365 * 24 * time.Hour}}}}
+	assert.Equal(t, idpExpiry, calculateExpiration(cfg, reqClaims.Expiry, nil, nil), "enrichment must not extend the minted expiry")
+
+	_, err = newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: server.URL}, Namespace: "exp"}})
+	assert.ErrorContains(t, err, `namespace "exp"`)
+}
+
+func TestRunEnrichment_NATS(t *testing.T) {
+	ensurePropagator(t)
+
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	require.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	traceparents := make(chan string, 1)
+	_, err = nc.Subscribe("directory.claims", func(msg *nats.Msg) {
+		traceparents <- msg.Header.Get("traceparent")
+		var claims map[string]interface{}
+		_ = json.Unmarshal(msg.Data, &claims)
+		if claims["sub"] == "mallory" {
+			reply := nats.NewMsg(msg.Reply)
+			reply.Header.Set(natsServiceErrorHeader, "unknown user")
+			_ = msg.RespondMsg(reply)
+			return
+		}
+		_ = msg.Respond([]byte(`{"teams":["payments"]}`))
+	})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	stages, err := newEnrichmentStages([]EnrichmentConfig{{NATS: NATSEnrichmentConfig{Subject: "directory.claims"}, Namespace: "directory"}})
+	require.NoError(t, err)
+	assert.Equal(t, "nats", stages[0].name)
+
+	ctx := tracing.ExtractFromTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	enriched, err := runEnrichment(ctx, nil, nc, "sso", stages, map[string]interface{}{"sub": "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"teams": []interface{}{"payments"}}, enriched["directory"])
+	assert.Contains(t, <-traceparents, "4bf92f3577b34da6a3ce929d0e0e4736", "trace context should propagate to the service")
+
+	_, err = runEnrichment(ctx, nil, nc, "sso", stages, map[string]interface{}{"sub": "mallory"})
+	<-traceparents
+	assert.ErrorContains(t, err, "unknown user")
+
+	stages, err = newEnrichmentStages([]EnrichmentConfig{{NATS: NATSEnrichmentConfig{Subject: "nobody.listens"}}})
+	require.NoError(t, err)
+	_, err = runEnrichment(ctx, nil, nc, "sso", stages, map[string]interface{}{"sub": "alice"})
+	assert.ErrorIs(t, err, nats.ErrNoResponders)
+}
+
+func TestNewEnrichmentStages_Source(t *testing.T) {
+	_, err := newEnrichmentStages([]EnrichmentConfig{{Namespace: "directory"}})
+	assert.EqualError(t, err, "enrichment[0] has no source; set http.url or nats.subject")
+
+	_, err = newEnrichmentStages([]EnrichmentConfig{{HTTP: HTTPEnrichmentConfig{URL: "http://directory"}, NATS: NATSEnrichmentConfig{Subject: "directory.claims"}}})
+	assert.EqualError(t, err, "enrichment[0] sets both http.url and nats.subject")
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+const (
+	// maxIntrospectionResponseSize bounds the introspection response body read into memory.
+	maxIntrospectionResponseSize = 1 << 20
+
+	// inactiveTokenCacheTTL is how long a token reported inactive is rejected
+	// without asking the IDP again.
+	inactiveTokenCacheTTL = 30 * time.Second
+)
+
+var errTokenInactive = errors.New("token is not active")
+
+// tokenIntrospector resolves opaque access tokens through an RFC 7662
+// introspection endpoint. Active responses are cached until the token expires,
+// inactive ones for inactiveTokenCacheTTL.
+type tokenIntrospector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	cache        *ttlCache[map[string]interface{}]
+	inactive     *ttlCache[struct{}]
+}
+
+func newTokenIntrospector(endpoint string, clientID string, clientSecret string) *tokenIntrospector {
+	return &tokenIntrospector{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: oidcTimeout},
+		cache:        newTTLCache[map[string]interface{}](0),
+		inactive:     newTTLCache[struct{}](0),
+	}
+}
+
+// discoveredIntrospectionEndpoint returns the introspection_endpoint advertised
+// in the provider's discovery document.
+func discoveredIntrospectionEndpoint(provider *oidc.Provider) (string, error) {
+	var discovery struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return "", fmt.Errorf("error reading discovery document: %w", err)
+	}
+	if discovery.IntrospectionEndpoint == "" {
+		return "", errors.New("idp does not advertise an introspection_endpoint; set introspection.endpoint")
+	}
+	return discovery.IntrospectionEndpoint, nil
+}
+
+// introspect returns the claims of an active token. Inactive tokens and tokens
+// without an expiry are rejected.
+func (i *tokenIntrospector) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	sum := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	if cached, ok := i.cache.get(cacheKey); ok {
+		return maps.Clone(cached), nil
+	}
+	if _, ok := i.inactive.get(cacheKey); ok {
+		return nil, errTokenInactive
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIntrospectionResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading introspection response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("error parsing introspection response: %w", err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		i.inactive.set(cacheKey, struct{}{}, time.Now().Add(inactiveTokenCacheTTL))
+		return nil, errTokenInactive
+	}
+	delete(claims, "active")
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || exp < 1 {
+		return nil, errors.New("missing 'exp' in introspection response")
+	}
+
+	// RFC 7662 names the resource owner 'username'; expose it under the
+	// standard OIDC claim unless the IDP already provides one.
+	if username, ok := claims["username"].(string); ok {
+		if _, exists := claims["preferred_username"]; !exists {
+			claims["preferred_username"] = username
+		}
+	}
+
+	i.cache.set(cacheKey, claims, time.Unix(int64(exp), 0))
+	return maps.Clone(claims), nil
+}
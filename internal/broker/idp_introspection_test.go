@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handleIntrospection registers an introspection endpoint on the mock provider
+// that answers with responses[token] (or inactive) and counts requests.
+func (m *mockOIDCProvider) handleIntrospection(t *testing.T, clientID, clientSecret string, responses map[string]map[string]interface{}) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	m.mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != clientID || pass != clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, found := responses[r.PostFormValue("token")]
+		if !found {
+			response = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	})
+	return &calls
+}
+
+func TestTokenIntrospector(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	exp := time.Now().Add(time.Hour).Unix()
+	calls := provider.handleIntrospection(t, "nats", "s3cret", map[string]map[string]interface{}{
+		"good":   {"active": true, "sub": "alice", "username": "alice.smith", "exp": exp, "scope": "nats"},
+		"no-exp": {"active": true, "sub": "bob"},
+	})
+	endpoint := provider.issuer() + "/introspect"
+
+	t.Run("active token is mapped and cached", func(t *testing.T) {
+		introspector := newTokenIntrospector(endpoint, "nats", "s3cret")
+		calls.Store(0)
+
+		claims, err := introspector.introspect(context.Background(), "good")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims["sub"])
+		assert.Equal(t, "alice.smith", claims["preferred_username"])
+		assert.NotContains(t, claims, "active")
+
+		claims["sub"] = "mutated"
+		claims, err = introspector.introspect(context.Background(), "good")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims["sub"], "cached claims should not be shared with callers")
+		assert.Equal(t, int32(1), calls.Load(), "second lookup should be served from cache")
+	})
+
+	t.Run("inactive token is cached briefly", func(t *testing.T) {
+		introspector := newTokenIntrospector(endpoint, "nats", "s3cret")
+		calls.Store(0)
+
+		_, err := introspector.introspect(context.Background(), "revoked")
+		assert.EqualError(t, err, "token is not active")
+		_, err = introspector.introspect(context.Background(), "revoked")
+		assert.ErrorIs(t, err, errTokenInactive)
+		assert.Equal(t, int32(1), calls.Load(), "a repeated inactive token should not reach the idp again")
+	})
+
+	t.Run("missing expiry", func(t *testing.T) {
+		introspector := newTokenIntrospector(endpoint, "nats", "s3cret")
+		_, err := introspector.introspect(context.Background(), "no-exp")
+		assert.ErrorContains(t, err, "missing 'exp'")
+	})
+
+	t.Run("bad client credentials", func(t *testing.T) {
+		introspector := newTokenIntrospector(endpoint, "nats", "wrong")
+		_, err := introspector.introspect(context.Background(), "good")
+		assert.ErrorContains(t, err, "401")
+	})
+}
+
+func TestRunVerification_OpaqueToken(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	provider.handleIntrospection(t, "nats", "s3cret", map[string]map[string]interface{}{
+		"opaque":       {"active": true, "sub": "alice", "iss": provider.issuer(), "client_id": "nats", "exp": time.Now().Add(time.Hour).Unix()},
+		"for-audience": {"active": true, "sub": "alice", "iss": provider.issuer(), "client_id": "web", "aud": []interface{}{"api", "nats"}, "exp": time.Now().Add(time.Hour).Unix()},
+		"other-client": {"active": true, "sub": "eve", "iss": provider.issuer(), "client_id": "web", "aud": "api", "exp": time.Now().Add(time.Hour).Unix()},
+		"no-client":    {"active": true, "sub": "eve", "iss": provider.issuer(), "exp": time.Now().Add(time.Hour).Unix()},
+		"foreign":      {"active": true, "sub": "eve", "iss": "https://other", "client_id": "nats", "exp": time.Now().Add(time.Hour).Unix()},
+	})
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "jwt-only", IssuerURL: provider.issuer(), ClientID: "nats"},
+			{Description: "introspect", IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s3cret", Introspection: IntrospectionConfig{Enabled: true}},
+		},
+	}
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+	require.Len(t, verifiers, 2)
+
+	t.Run("active opaque token", func(t *testing.T) {
+		claims, matched, idToken, err := runVerification(context.Background(), "opaque", verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.NotZero(t, claims.Expiry)
+		assert.Equal(t, "introspect", matched.config.Description)
+		assert.Nil(t, idToken)
+	})
+
+	t.Run("token for our audience", func(t *testing.T) {
+		claims, _, _, err := runVerification(context.Background(), "for-audience", verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "nats", claims.IdpClientID)
+	})
+
+	t.Run("token for another client", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "other-client", verifiers)
+		assert.ErrorContains(t, err, `issued to client "web"`)
+
+		_, _, _, err = runVerification(context.Background(), "no-client", verifiers)
+		assert.ErrorContains(t, err, "expected one of [nats]")
+	})
+
+	t.Run("inactive opaque token", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "unknown", verifiers)
+		assert.ErrorContains(t, err, "token is not active")
+	})
+
+	t.Run("issuer mismatch", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "foreign", verifiers)
+		assert.ErrorContains(t, err, "expected")
+	})
+
+	t.Run("no introspection idp", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "opaque", verifiers[:1])
+		assert.EqualError(t, err, "token is not a jwt and no idp has introspection enabled")
+	})
+}
+
+func TestNewVerifierForIdp_Introspection(t *testing.T) {
+	ctx := NewServerContext(nil)
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+
+	t.Run("endpoint from discovery", func(t *testing.T) {
+		verifier, err := newVerifierForIdp(ctx, &Idp{IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s", Introspection: IntrospectionConfig{Enabled: true}})
+		require.NoError(t, err)
+		assert.Equal(t, provider.issuer()+"/introspect", verifier.introspector.endpoint)
+	})
+
+	t.Run("explicit endpoint", func(t *testing.T) {
+		verifier, err := newVerifierForIdp(ctx, &Idp{IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s", Introspection: IntrospectionConfig{Enabled: true, Endpoint: "https://idp/introspect"}})
+		require.NoError(t, err)
+		assert.Equal(t, "https://idp/introspect", verifier.introspector.endpoint)
+	})
+
+	t.Run("client secret required", func(t *testing.T) {
+		_, err := newVerifierForIdp(ctx, &Idp{IssuerURL: provider.issuer(), ClientID: "nats", Introspection: IntrospectionConfig{Enabled: true}})
+		assert.ErrorContains(t, err, "client_secret")
+	})
+}
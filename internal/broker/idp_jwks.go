@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"go.uber.org/zap"
+)
+
+// loadStaticKeySet builds a static key set from the JWKS file and inline keys
+// configured for an IDP. Keys from both sources are combined.
+func loadStaticKeySet(cfg IdpJwksConfig) (*oidc.StaticKeySet, error) {
+	var keys []jose.JSONWebKey
+
+	if cfg.File != "" {
+		fileKeys, err := readJwksFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	for i, inline := range cfg.Keys {
+		raw, err := json.Marshal(inline)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding inline jwk %d: %w", i, err)
+		}
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("error parsing inline jwk %d: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+
+	signingKeys := make([]jose.JSONWebKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Use != "" && key.Use != "sig" {
+			zap.L().Debug("skipping jwk not intended for signatures", zap.String("kid", key.KeyID), zap.String("use", key.Use))
+			continue
+		}
+		signingKeys = append(signingKeys, key)
+	}
+
+	return newStaticKeySet(signingKeys)
+}
+
+// readJwksFile reads the keys of the JWKS document at path, after expanding
+// environment variables in the path.
+func readJwksFile(path string) ([]jose.JSONWebKey, error) {
+	raw, err := os.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading jwks file: %w", err)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &keySet); err != nil {
+		return nil, fmt.Errorf("error parsing jwks file %s: %w", path, err)
+	}
+	return keySet.Keys, nil
+}
+
+// newStaticKeySet returns a key set holding the public halves of keys.
+func newStaticKeySet(keys []jose.JSONWebKey) (*oidc.StaticKeySet, error) {
+	publicKeys := make([]crypto.PublicKey, 0, len(keys))
+	for _, key := range keys {
+		public := key.Public()
+		if public.Key == nil {
+			return nil, fmt.Errorf("jwk %q is not an asymmetric key; only public keys are supported", key.KeyID)
+		}
+		publicKeys = append(publicKeys, public.Key)
+	}
+
+	if len(publicKeys) == 0 {
+		return nil, errors.New("no usable signing keys found in jwks")
+	}
+
+	return &oidc.StaticKeySet{PublicKeys: publicKeys}, nil
+}
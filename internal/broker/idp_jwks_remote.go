@@ -0,0 +1,256 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultJwksRefreshInterval    = time.Hour
+	DefaultJwksMinRefreshInterval = 30 * time.Second
+
+	maxJwksResponseSize = 1 << 20
+)
+
+// jwsAlgorithms lists the signature algorithms accepted when parsing tokens
+// in the key set. The verifier has already restricted the algorithm further.
+var jwsAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// supportedJwsAlgorithms returns the algorithms in advertised that tokens can
+// be verified with, as go-oidc's provider does for its own key set.
+func supportedJwsAlgorithms(advertised []string) []string {
+	var algorithms []string
+	for _, alg := range advertised {
+		for _, supported := range jwsAlgorithms {
+			if alg == string(supported) {
+				algorithms = append(algorithms, alg)
+				break
+			}
+		}
+	}
+	return algorithms
+}
+
+// remoteKeySet verifies signatures against an IDP's jwks_uri. Keys are fetched
+// again in the background once refreshInterval has passed, while the cached
+// keys keep being served, and in line when a token names an unknown kid. No
+// fetch is made within minRefreshInterval of the last, so tokens with made-up
+// kids cannot be used to hammer the IDP.
+type remoteKeySet struct {
+	idp                string // IDP description, used as the metrics label
+	jwksURL            string
+	client             *http.Client
+	metrics            *metrics.Metrics
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	now                func() time.Time
+
+	fetchMu     sync.Mutex  // serialises fetches
+	refreshing  atomic.Bool // set while a background refresh runs
+	mu          sync.RWMutex
+	keys        []jose.JSONWebKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+func newRemoteKeySet(idp string, jwksURL string, cfg IdpJwksConfig, m *metrics.Metrics) *remoteKeySet {
+	refreshInterval := cfg.RefreshInterval.Duration
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultJwksRefreshInterval
+	}
+	minRefreshInterval := cfg.MinRefreshInterval.Duration
+	if minRefreshInterval <= 0 {
+		minRefreshInterval = DefaultJwksMinRefreshInterval
+	}
+
+	return &remoteKeySet{
+		idp:                idp,
+		jwksURL:            jwksURL,
+		client:             &http.Client{Timeout: oidcTimeout},
+		metrics:            m,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: minRefreshInterval,
+		now:                time.Now,
+	}
+}
+
+// VerifySignature implements oidc.KeySet.
+func (r *remoteKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, jwsAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %w", err)
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	if r.stale() {
+		r.refreshStale(ctx)
+	}
+	if payload, found, err := r.verifyWithKeys(jws, kid); found {
+		return payload, err
+	}
+
+	// Unknown kid: the IDP may have rotated its keys since the last fetch.
+	refreshed := r.refresh(ctx, true)
+	if r.metrics != nil {
+		result := metrics.ResultRefreshed
+		if !refreshed {
+			result = metrics.ResultRateLimited
+		}
+		r.metrics.JwksKeyMisses.WithLabelValues(r.idp, result).Inc()
+	}
+	if refreshed {
+		if payload, found, err := r.verifyWithKeys(jws, kid); found {
+			return payload, err
+		}
+	}
+	return nil, fmt.Errorf("no jwks key found for kid %q", kid)
+}
+
+// verifyWithKeys verifies jws with the cached keys matching kid (all keys if
+// kid is empty). found is false if no key matched.
+func (r *remoteKeySet) verifyWithKeys(jws *jose.JSONWebSignature, kid string) ([]byte, bool, error) {
+	r.mu.RLock()
+	keys := r.keys
+	r.mu.RUnlock()
+
+	found := false
+	for _, key := range keys {
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+		found = true
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true, nil
+		}
+	}
+	if found {
+		return nil, true, errors.New("failed to verify signature with jwks keys")
+	}
+	return nil, false, nil
+}
+
+// stale reports whether the keys are due for a periodic refresh.
+func (r *remoteKeySet) stale() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.now().Sub(r.fetchedAt) >= r.refreshInterval
+}
+
+// refreshStale refreshes keys that are due for a periodic refresh. Until the
+// first fetch there are no keys to serve, so it waits; afterwards the fetch
+// runs in the background and the cached keys are used meanwhile.
+func (r *remoteKeySet) refreshStale(ctx context.Context) {
+	r.mu.RLock()
+	fetched := !r.fetchedAt.IsZero()
+	r.mu.RUnlock()
+
+	if !fetched {
+		r.refresh(ctx, false)
+		return
+	}
+	if !r.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.refreshing.Store(false)
+		r.refresh(context.WithoutCancel(ctx), false)
+	}()
+}
+
+// refresh fetches the keys unless another fetch was attempted within
+// minRefreshInterval. force skips the check that the keys are stale, for
+// unknown kids. It reports whether the keys were fetched successfully.
+func (r *remoteKeySet) refresh(ctx context.Context, force bool) bool {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+
+	r.mu.RLock()
+	lastAttempt := r.lastAttempt
+	r.mu.RUnlock()
+
+	// Another request may have refreshed while this one waited for the lock.
+	if !force && !r.stale() {
+		return true
+	}
+	if !lastAttempt.IsZero() && r.now().Sub(lastAttempt) < r.minRefreshInterval {
+		return false
+	}
+
+	r.mu.Lock()
+	r.lastAttempt = r.now()
+	r.mu.Unlock()
+
+	keys, err := r.fetch(ctx)
+	if err != nil {
+		zap.L().Warn("failed to fetch jwks", zap.String("idp", r.idp), zap.String("url", r.jwksURL), zap.Error(err))
+		if r.metrics != nil {
+			r.metrics.JwksFetches.WithLabelValues(r.idp, metrics.StatusError).Inc()
+		}
+		return false
+	}
+
+	fetchedAt := r.now()
+	r.mu.Lock()
+	r.keys = keys
+	r.fetchedAt = fetchedAt
+	r.mu.Unlock()
+
+	zap.L().Debug("fetched jwks", zap.String("idp", r.idp), zap.Int("keys", len(keys)))
+	if r.metrics != nil {
+		r.metrics.JwksFetches.WithLabelValues(r.idp, metrics.StatusSuccess).Inc()
+		r.metrics.JwksKeys.WithLabelValues(r.idp).Set(float64(len(keys)))
+		r.metrics.JwksLastRefresh.WithLabelValues(r.idp).Set(float64(fetchedAt.Unix()))
+	}
+	return true
+}
+
+// fetch downloads the signing keys from the jwks_uri. The fetch is shared by
+// every request waiting for the keys, so it is not cancelled with the request
+// that started it.
+func (r *remoteKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	fetchCtx, fetchCancel := context.WithTimeout(context.WithoutCancel(ctx), oidcTimeout)
+	defer fetchCancel()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, r.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned %s", resp.Status)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJwksResponseSize)).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("error parsing jwks: %w", err)
+	}
+
+	keys := make([]jose.JSONWebKey, 0, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteKeySet_Refresh(t *testing.T) {
+	k1 := newTestSigner(t, "k1")
+	k2 := newTestSigner(t, "k2")
+
+	var served atomic.Pointer[testSigner]
+	served.Store(k1)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(served.Load().jwksJSON(t))
+	}))
+	t.Cleanup(server.Close)
+
+	keySet := newRemoteKeySet("sso", server.URL, IdpJwksConfig{
+		RefreshInterval:    Duration{time.Hour},
+		MinRefreshInterval: Duration{time.Minute},
+	}, nil)
+	now := time.Now()
+	keySet.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	claims := map[string]interface{}{"sub": "alice"}
+
+	_, err := keySet.VerifySignature(ctx, k1.mint(t, claims))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), fetches.Load(), "keys should be fetched on first use")
+
+	_, err = keySet.VerifySignature(ctx, k1.mint(t, claims))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), fetches.Load(), "known kids should not trigger a fetch")
+
+	// The IDP rotates to k2 straight after the first fetch.
+	served.Store(k2)
+	now = now.Add(10 * time.Second)
+	_, err = keySet.VerifySignature(ctx, k2.mint(t, claims))
+	assert.ErrorContains(t, err, `no jwks key found for kid "k2"`)
+	assert.Equal(t, int32(1), fetches.Load(), "unknown kids should not refresh within min_refresh_interval")
+
+	now = now.Add(time.Minute)
+	_, err = keySet.VerifySignature(ctx, k2.mint(t, claims))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), fetches.Load(), "an unknown kid should refresh the keys")
+
+	_, err = keySet.VerifySignature(ctx, k1.mint(t, claims))
+	assert.ErrorContains(t, err, `no jwks key found for kid "k1"`, "rotated out keys should no longer verify")
+
+	now = now.Add(2 * time.Hour)
+	_, err = keySet.VerifySignature(ctx, k2.mint(t, claims))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return fetches.Load() == 3 }, 2*time.Second, 10*time.Millisecond,
+		"keys should be refreshed after refresh_interval")
+}
+
+func TestRemoteKeySet_StaleRefreshDoesNotBlock(t *testing.T) {
+	k1 := newTestSigner(t, "k1")
+
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_, _ = w.Write(k1.jwksJSON(t))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	keySet := newRemoteKeySet("sso", server.URL, IdpJwksConfig{RefreshInterval: Duration{time.Hour}}, nil)
+	var now atomic.Int64
+	now.Store(time.Now().UnixNano())
+	keySet.now = func() time.Time { return time.Unix(0, now.Load()) }
+
+	token := k1.mint(t, map[string]interface{}{"sub": "alice"})
+	_, err := keySet.VerifySignature(context.Background(), token)
+	require.NoError(t, err)
+
+	now.Add(int64(2 * time.Hour))
+	for range 3 {
+		_, err = keySet.VerifySignature(context.Background(), token)
+		require.NoError(t, err, "cached keys should be served while the refresh is pending")
+	}
+	assert.Eventually(t, func() bool { return fetches.Load() == 2 }, 2*time.Second, 10*time.Millisecond,
+		"one background refresh should be started")
+}
+
+func TestRemoteKeySet_CancelledRequestStillFetches(t *testing.T) {
+	k1 := newTestSigner(t, "k1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(k1.jwksJSON(t))
+	}))
+	t.Cleanup(server.Close)
+
+	keySet := newRemoteKeySet("sso", server.URL, IdpJwksConfig{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := keySet.VerifySignature(ctx, k1.mint(t, map[string]interface{}{"sub": "alice"}))
+	assert.NoError(t, err, "a cancelled request should not fail the shared fetch")
+}
+
+func TestRemoteKeySet_FetchFailureKeepsKeys(t *testing.T) {
+	k1 := newTestSigner(t, "k1")
+
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(k1.jwksJSON(t))
+	}))
+	t.Cleanup(server.Close)
+
+	keySet := newRemoteKeySet("sso", server.URL, IdpJwksConfig{RefreshInterval: Duration{time.Hour}}, nil)
+	now := time.Now()
+	keySet.now = func() time.Time { return now }
+
+	token := k1.mint(t, map[string]interface{}{"sub": "alice"})
+	_, err := keySet.VerifySignature(context.Background(), token)
+	require.NoError(t, err)
+
+	failing.Store(true)
+	now = now.Add(2 * time.Hour)
+	_, err = keySet.VerifySignature(context.Background(), token)
+	assert.NoError(t, err, "the last fetched keys should be used while the jwks_uri is unavailable")
+}
+
+func TestSupportedJwsAlgorithms(t *testing.T) {
+	assert.Equal(t, []string{"RS256", "ES384"}, supportedJwsAlgorithms([]string{"RS256", "HS256", "none", "ES384"}))
+	assert.Empty(t, supportedJwsAlgorithms(nil))
+}
@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSigner holds an RSA key pair used to mint IDP tokens in tests.
+type testSigner struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return &testSigner{key: key, kid: kid}
+}
+
+// jwk returns the public half of the signing key as a JWK.
+func (s *testSigner) jwk() jose.JSONWebKey {
+	return jose.JSONWebKey{Key: &s.key.PublicKey, KeyID: s.kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+// jwksJSON returns a JWKS document containing the public key.
+func (s *testSigner) jwksJSON(t *testing.T) []byte {
+	t.Helper()
+	raw, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{s.jwk()}})
+	require.NoError(t, err)
+	return raw
+}
+
+// writeJwks writes the JWKS document to path.
+func (s *testSigner) writeJwks(t *testing.T, path string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, s.jwksJSON(t), 0644))
+}
+
+// mint signs claims as a JWT. iat and exp default to now and now+1h; a nil
+// value omits the claim.
+func (s *testSigner) mint(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: s.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), s.kid),
+	)
+	require.NoError(t, err)
+
+	now := time.Now()
+	all := map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(all, k)
+			continue
+		}
+		all[k] = v
+	}
+
+	token, err := josejwt.Signed(signer).Claims(all).Serialize()
+	require.NoError(t, err)
+	return token
+}
+
+func TestLoadStaticKeySet(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+
+	t.Run("from file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		signer.writeJwks(t, path)
+
+		keySet, err := loadStaticKeySet(IdpJwksConfig{File: path})
+		require.NoError(t, err)
+		assert.Len(t, keySet.PublicKeys, 1)
+	})
+
+	t.Run("inline keys", func(t *testing.T) {
+		var inline map[string]interface{}
+		raw, err := json.Marshal(signer.jwk())
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(raw, &inline))
+
+		keySet, err := loadStaticKeySet(IdpJwksConfig{Keys: []map[string]interface{}{inline}})
+		require.NoError(t, err)
+		assert.Len(t, keySet.PublicKeys, 1)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := loadStaticKeySet(IdpJwksConfig{File: filepath.Join(t.TempDir(), "missing.json")})
+		assert.Error(t, err)
+	})
+
+	t.Run("no signing keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		require.NoError(t, os.WriteFile(path, []byte(`{"keys":[]}`), 0644))
+
+		_, err := loadStaticKeySet(IdpJwksConfig{File: path})
+		assert.ErrorContains(t, err, "no usable signing keys")
+	})
+
+	t.Run("encryption keys are skipped", func(t *testing.T) {
+		encKey := signer.jwk()
+		encKey.Use = "enc"
+		raw, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{encKey}})
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		require.NoError(t, os.WriteFile(path, raw, 0644))
+
+		_, err = loadStaticKeySet(IdpJwksConfig{File: path})
+		assert.Error(t, err)
+	})
+}
+
+func TestStaticJwksVerification(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	signer.writeJwks(t, path)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "offline", IssuerURL: "https://idp.airgap", ClientID: "nats", Jwks: IdpJwksConfig{File: path}},
+		},
+	}
+
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+	require.Len(t, verifiers, 1)
+
+	t.Run("valid token", func(t *testing.T) {
+		token := signer.mint(t, map[string]interface{}{"iss": "https://idp.airgap", "aud": "nats", "sub": "alice"})
+		claims, matched, _, err := runVerification(context.Background(), token, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, "offline", matched.config.Description)
+	})
+
+	t.Run("wrong issuer", func(t *testing.T) {
+		token := signer.mint(t, map[string]interface{}{"iss": "https://other", "aud": "nats", "sub": "alice"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown signing key", func(t *testing.T) {
+		other := newTestSigner(t, "k2")
+		token := other.mint(t, map[string]interface{}{"iss": "https://idp.airgap", "aud": "nats", "sub": "alice"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.Error(t, err)
+	})
+
+	t.Run("user info unavailable", func(t *testing.T) {
+		_, err := verifiers[0].verifier.GetUserInfo(context.Background(), "access-token", nil)
+		assert.ErrorContains(t, err, "without discovery")
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -34,6 +36,10 @@ var jsonToField = map[string]string{
 	"also_known_as":      "AlsoKnownAs",
 }
 
+// idpClientIDClaim is set on the request claims to the client id the token
+// was accepted for, so that role bindings can match on it.
+const idpClientIDClaim = "idp_client_id"
+
 // Standard claims that are handled by the IdpJwtClaims struct
 var standardClaims = func() map[string]bool {
 	claims := make(map[string]bool)
@@ -69,6 +75,10 @@ type IdpJwtClaims struct {
 	AccessTokenHash   string                 `json:"at_hash,omitempty"`
 	AlsoKnownAs       string                 `json:"also_known_as,omitempty"`
 	CustomClaims      map[string]interface{} `json:"-"`
+
+	// IdpClientID is the configured client id the token was accepted for.
+	// It is set by verification, never read from the token.
+	IdpClientID string `json:"-"`
 }
 
 type JwtClaimAudience []string
@@ -117,7 +127,7 @@ func (j *IdpJwtClaims) exists(expected []string) error {
 	claimsMap := j.toMap()
 	zap.L().Debug("idp claims", zap.Any("claims", claimsMap))
 	for _, claimName := range expected {
-		_, found := claimsMap[claimName]
+		_, found := claimAtPath(claimsMap, claimName)
 
 		if !found {
 			return fmt.Errorf("missing or empty claim '%s' in idp token", claimName)
@@ -139,6 +149,23 @@ func (j *IdpJwtClaims) validateAudience(expected []string) error {
 	return fmt.Errorf("idp 'aud' did not match expected. 0 == intersect(%v, %v)", j.Audience, expected)
 }
 
+// validateAuthorizedParty checks the 'azp' claim as OIDC Core 3.1.3.7
+// describes: a token with several audiences must name one of clientIDs as its
+// authorized party, and any 'azp' present must be one of clientIDs.
+func (j *IdpJwtClaims) validateAuthorizedParty(clientIDs []string) error {
+	azp, _ := j.CustomClaims["azp"].(string)
+	if azp == "" {
+		if len(j.Audience) > 1 {
+			return fmt.Errorf("idp token has %d audiences but no 'azp' claim", len(j.Audience))
+		}
+		return nil
+	}
+	if !slices.Contains(clientIDs, azp) {
+		return fmt.Errorf("idp 'azp' (%s) did not match client_id (%s)", azp, strings.Join(clientIDs, ", "))
+	}
+	return nil
+}
+
 func (j *IdpJwtClaims) validateExpiryBounds(bounds DurationBounds) error {
 	now := time.Now().Unix()
 	ttl := time.Duration((j.Expiry - now) * int64(time.Second))
@@ -257,4 +284,14 @@ func (j *IdpJwtClaims) fromMap(m map[string]interface{}, customMapping map[strin
 			j.CustomClaims[k] = v
 		}
 	}
+
+	// Mappings from nested claim paths copy the value; the nested claim is kept
+	for from, to := range customMapping {
+		if _, topLevel := m[from]; topLevel || !isClaimPath(from) {
+			continue
+		}
+		if v, ok := claimAtPath(m, from); ok {
+			j.CustomClaims[to] = v
+		}
+	}
 }
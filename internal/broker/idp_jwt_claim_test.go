@@ -308,6 +308,22 @@ func TestIdpJwtClaims_Exists(t *testing.T) {
 			requiredClaims: []string{"custom:claim1", "custom:claim2"},
 			shouldSucceed:  true,
 		},
+		{
+			name: "nested claim path exists",
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+			},
+			requiredClaims: []string{"realm_access.roles", "/realm_access/roles/0"},
+			shouldSucceed:  true,
+		},
+		{
+			name: "nested claim path missing",
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+			},
+			requiredClaims: []string{"realm_access.groups"},
+			shouldSucceed:  false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -610,3 +626,23 @@ func (j *IdpJwtClaims) hasPermission(requiredPermission string) bool {
 	}
 	return false
 }
+
+func TestIdpJwtClaims_NestedCustomMapping(t *testing.T) {
+	claims := &IdpJwtClaims{}
+	claims.fromMap(map[string]interface{}{
+		"sub":          "user1",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "user"}},
+		"tenant":       "acme",
+	}, map[string]string{
+		"realm_access.roles":    "realm_roles",
+		"/realm_access/roles/0": "primary_role",
+		"tenant":                "org",
+		"missing.path":          "unused",
+	})
+
+	assert.Equal(t, []interface{}{"admin", "user"}, claims.CustomClaims["realm_roles"])
+	assert.Equal(t, "admin", claims.CustomClaims["primary_role"])
+	assert.Equal(t, "acme", claims.CustomClaims["org"])
+	assert.Contains(t, claims.CustomClaims, "realm_access", "nested source claim is kept")
+	assert.NotContains(t, claims.CustomClaims, "unused")
+}
@@ -2,8 +2,12 @@ package broker
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -21,30 +25,271 @@ type IdpAndJwtVerifier struct {
 }
 
 func NewIdpVerifiers(ctx *Context, config *Config) ([]IdpAndJwtVerifier, error) {
+	idpVerifiers, _, err := newIdpVerifierSet(ctx, config)
+	return idpVerifiers, err
+}
+
+// newIdpVerifierSet creates a verifier for each configured IDP. IDPs that fail
+// setup with ignore_setup_error enabled are returned as pending, so they can be
+// retried in the background by the IdpSupervisor.
+func newIdpVerifierSet(ctx *Context, config *Config) ([]IdpAndJwtVerifier, []*Idp, error) {
 	idpVerifiers := make([]IdpAndJwtVerifier, 0, len(config.Idp))
+	var pending []*Idp
 	for i := range config.Idp {
 		idp := &config.Idp[i] // Use a pointer to the IDP config
-		idpVerifier, err := NewJwtVerifier(ctx, idp.ClientID, idp.IssuerURL, idp.MaxTokenLifetime.Duration, idp.ClockSkew.Duration)
+		idpVerifier, err := newVerifierForIdp(ctx, idp)
 		if err != nil {
 			if idp.IgnoreSetupError {
-				zap.L().Warn("Failed to setup IDP verifier, ignoring due to config", zap.Error(err), zap.String("issuer_url", idp.IssuerURL), zap.String("client_id", idp.ClientID))
+				zap.L().Warn("Failed to setup IDP verifier, ignoring due to config", zap.Error(err), zap.String("issuer_url", idp.IssuerURL), zap.Strings("client_ids", idp.clientIDs()))
+				pending = append(pending, idp)
 				continue // Skip this IDP and continue with the next one
 			}
 
-			zap.L().Error("Failed to setup IDP verifier, halting startup", zap.Error(err), zap.String("issuer_url", idp.IssuerURL), zap.String("client_id", idp.ClientID))
-			return nil, fmt.Errorf("failed to setup verifier for IDP %s (%s): %w", idp.Description, idp.IssuerURL, err)
+			zap.L().Error("Failed to setup IDP verifier, halting startup", zap.Error(err), zap.String("issuer_url", idp.IssuerURL), zap.Strings("client_ids", idp.clientIDs()))
+			return nil, nil, fmt.Errorf("failed to setup verifier for IDP %s (%s): %w", idp.Description, idp.IssuerURL, err)
 		}
 		idpVerifiers = append(idpVerifiers, IdpAndJwtVerifier{idpVerifier, idp}) // Pass the pointer to the config
 	}
-	return idpVerifiers, nil
+	return idpVerifiers, pending, nil
+}
+
+// newVerifierForIdp creates the verifier for a single IDP entry, using a static
+// key set when one is configured and OIDC discovery otherwise.
+func newVerifierForIdp(ctx *Context, idp *Idp) (*IdpJwtVerifier, error) {
+	assertions, err := compileAssertions(idp.ValidationSpec.Assert)
+	if err != nil {
+		return nil, err
+	}
+	enrichment, err := newEnrichmentStages(idp.Enrichment)
+	if err != nil {
+		return nil, err
+	}
+	transforms, err := compileClaimTransforms(idp.Transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	if idp.ClientCert.Enabled {
+		clientCert, err := newClientCertVerifier(idp.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+		verifier := NewClientCertVerifier(ctx, clientCert)
+		verifier.assertions = assertions
+		verifier.enrichment = enrichment
+		verifier.transforms = transforms
+		return verifier, nil
+	}
+
+	var verifier *IdpJwtVerifier
+	if trustDomain := spiffeTrustDomainOf(idp.IssuerURL); trustDomain != "" {
+		keySet, err := loadSpiffeBundle(idp.Spiffe.BundleFile)
+		if err != nil {
+			return nil, err
+		}
+		verifier = NewSpiffeJwtVerifier(ctx, idp.clientIDs(), trustDomain, keySet, idp.MaxTokenLifetime.Duration, idp.ClockSkew.Duration, idp.ValidationSpec.Algorithms)
+	} else if idp.Jwks.isStatic() {
+		keySet, err := loadStaticKeySet(idp.Jwks)
+		if err != nil {
+			return nil, err
+		}
+		verifier = NewStaticJwtVerifier(ctx, idp.clientIDs(), idp.IssuerURL, keySet, idp.MaxTokenLifetime.Duration, idp.ClockSkew.Duration, idp.ValidationSpec.Algorithms)
+	} else {
+		verifier, err = NewJwtVerifier(ctx, idp.Description, idp.clientIDs(), idp.IssuerURL, idp.Jwks, idp.MaxTokenLifetime.Duration, idp.ClockSkew.Duration, idp.ValidationSpec.Algorithms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	verifier.assertions = assertions
+	verifier.enrichment = enrichment
+	verifier.transforms = transforms
+
+	if idp.DistributedClaims.Enabled {
+		verifier.distributedClaims = newDistributedClaims(idp.Description, idp.DistributedClaims, verifier)
+	}
+
+	if idp.UserInfo.Enabled && idp.UserInfo.CacheTTL.Duration > 0 {
+		verifier.userInfoCache = newUserInfoCache(idp.Description, idp.UserInfo, ctx.Metrics)
+	}
+
+	if idp.Introspection.Enabled {
+		if idp.ClientSecret == "" {
+			return nil, errors.New("introspection requires a client_secret")
+		}
+		endpoint := idp.Introspection.Endpoint
+		if endpoint == "" {
+			if verifier.provider == nil {
+				return nil, errors.New("introspection.endpoint is required for an idp without discovery")
+			}
+			endpoint, err = discoveredIntrospectionEndpoint(verifier.provider)
+			if err != nil {
+				return nil, err
+			}
+		}
+		verifier.introspector = newTokenIntrospector(endpoint, idp.primaryClientID(), idp.ClientSecret)
+	}
+
+	if idp.PasswordGrant.Enabled {
+		tokenURL, err := verifier.tokenEndpoint(idp.PasswordGrant.TokenEndpoint, "password_grant")
+		if err != nil {
+			return nil, err
+		}
+		verifier.passwordGrant = newPasswordGrant(idp.PasswordGrant, idp.primaryClientID(), idp.ClientSecret, tokenURL)
+	}
+
+	if idp.Refresh.Enabled {
+		tokenURL, err := verifier.tokenEndpoint(idp.Refresh.TokenEndpoint, "refresh")
+		if err != nil {
+			return nil, err
+		}
+		verifier.refresher = newTokenRefresher(idp.primaryClientID(), idp.ClientSecret, tokenURL)
+	}
+
+	return verifier, nil
+}
+
+// unverifiedRouting holds the claims used to pick verifiers for a token before
+// its signature has been checked. They must not be trusted for anything else.
+type unverifiedRouting struct {
+	Issuer   string           `json:"iss"`
+	Subject  string           `json:"sub"`
+	Audience JwtClaimAudience `json:"aud"`
+	Azp      string           `json:"azp"`
+}
+
+// parseUnverifiedRouting decodes the payload of a compact JWT without verifying
+// its signature.
+func parseUnverifiedRouting(jwtToken string) (*unverifiedRouting, error) {
+	parts := strings.Split(jwtToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt: expected 3 parts, got %d", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %w", err)
+	}
+
+	var routing unverifiedRouting
+	if err := json.Unmarshal(payload, &routing); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", err)
+	}
+	return &routing, nil
+}
+
+// checkTokenType checks the JOSE 'typ' header of a compact JWT against
+// expected. Following RFC 8725, the comparison ignores case and an
+// "application/" prefix. An empty expected type accepts any header.
+func checkTokenType(jwtToken string, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	header, _, _ := strings.Cut(jwtToken, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return fmt.Errorf("malformed jwt header: %w", err)
+	}
+	var parsed struct {
+		Typ string `json:"typ"`
+	}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return fmt.Errorf("malformed jwt header: %w", err)
+	}
+
+	normalize := func(typ string) string {
+		return strings.TrimPrefix(strings.ToLower(typ), "application/")
+	}
+	if normalize(parsed.Typ) != normalize(expected) {
+		return fmt.Errorf("jwt 'typ' header %q does not match expected %q", parsed.Typ, expected)
+	}
+	return nil
 }
 
+// routes reports whether the verifier is responsible for tokens with the given
+// routing claims: by iss for OIDC IDPs, and by the trust domain of the sub
+// SPIFFE ID for SPIFFE IDPs.
+func (v *IdpJwtVerifier) routes(routing *unverifiedRouting) bool {
+	if v.IDTokenVerifier == nil {
+		return false
+	}
+	if v.spiffeTrustDomain != "" {
+		id, err := parseSpiffeID(routing.Subject)
+		return err == nil && id.trustDomain == v.spiffeTrustDomain
+	}
+	return v.issuerURL == routing.Issuer
+}
+
+// routeVerifiers selects the verifiers responsible for the token's issuer.
+// When several IDPs share an issuer, those with a client id appearing in aud
+// or azp are preferred; if none do, all of them are returned so that
+// verification reports the mismatch.
+func routeVerifiers(jwtToken string, items []IdpAndJwtVerifier) ([]IdpAndJwtVerifier, error) {
+	routing, err := parseUnverifiedRouting(jwtToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []IdpAndJwtVerifier
+	for _, item := range items {
+		if item.verifier.routes(routing) {
+			candidates = append(candidates, item)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if id, err := parseSpiffeID(routing.Subject); err == nil {
+			return nil, fmt.Errorf("no idp configured for spiffe trust domain %q", id.trustDomain)
+		}
+		return nil, fmt.Errorf("no idp configured for issuer %q", routing.Issuer)
+	}
+	if len(candidates) == 1 {
+		return candidates, nil
+	}
+
+	var narrowed []IdpAndJwtVerifier
+	for _, item := range candidates {
+		for _, clientID := range item.config.clientIDs() {
+			if clientID == routing.Azp || slices.Contains(routing.Audience, clientID) {
+				narrowed = append(narrowed, item)
+				break
+			}
+		}
+	}
+	if len(narrowed) > 0 {
+		return narrowed, nil
+	}
+	return candidates, nil
+}
+
+// runVerification verifies jwtToken against the IDP that issued it. Only
+// verifiers sharing the token's issuer are tried, in configuration order.
 func runVerification(ctx context.Context, jwtToken string, items []IdpAndJwtVerifier) (*IdpJwtClaims, *IdpAndJwtVerifier, *oidc.IDToken, error) {
+	if len(items) == 0 {
+		return nil, nil, nil, errors.New("no idp verifiers configured")
+	}
+
+	if !isCompactJWT(jwtToken) {
+		return runIntrospection(ctx, jwtToken, items)
+	}
+
+	candidates, err := routeVerifiers(jwtToken, items)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	var verificationErrors []error
-	for _, item := range items {
+	for _, item := range candidates {
 		if item.verifier.ctx.Options.LogSensitive {
 			zap.L().Debug("verifying jwt against spec", zap.String("jwt", jwtToken), zap.Any("spec", item.config.ValidationSpec))
 		}
+		if err := checkTokenType(jwtToken, item.config.ValidationSpec.Typ); err != nil {
+			verificationErrors = append(verificationErrors, fmt.Errorf("idp %s: %w", item.config.Description, err))
+			zap.L().Debug("unexpected token type, trying next idp", zap.String("idp", item.config.Description), zap.Error(err))
+			continue
+		}
+
 		reqClaims, idToken, err := item.verifier.verifyJWT(ctx, jwtToken, item.config.CustomMapping)
 		if err != nil {
 			verificationErrors = append(verificationErrors, fmt.Errorf("idp %s: %w", item.config.Description, err))
@@ -67,19 +312,81 @@ func runVerification(ctx context.Context, jwtToken string, items []IdpAndJwtVeri
 		return reqClaims, &item, idToken, nil
 	}
 
-	if len(verificationErrors) == 0 {
-		return nil, nil, nil, errors.New("no idp verifiers configured")
-	}
 	return nil, nil, nil, fmt.Errorf("no idp verifier matched token: %w", errors.Join(verificationErrors...))
 }
 
+// tokenEndpoint returns configured if set, and otherwise the token endpoint
+// from the IDP's discovery document. section names the config block that
+// needs the endpoint, for the error message.
+func (v *IdpJwtVerifier) tokenEndpoint(configured string, section string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if v.provider != nil && v.provider.Endpoint().TokenURL != "" {
+		return v.provider.Endpoint().TokenURL, nil
+	}
+	return "", fmt.Errorf("%s.token_endpoint is required for an idp without a discovered token_endpoint", section)
+}
+
+// isCompactJWT reports whether token has the three-part shape of a signed JWT.
+// Anything else is treated as an opaque access token.
+func isCompactJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// runIntrospection verifies an opaque token against each IDP with
+// introspection enabled, in configuration order. Opaque tokens carry no
+// issuer, so the first IDP that reports the token as active wins.
+func runIntrospection(ctx context.Context, token string, items []IdpAndJwtVerifier) (*IdpJwtClaims, *IdpAndJwtVerifier, *oidc.IDToken, error) {
+	var introspectionErrors []error
+	for _, item := range items {
+		if item.verifier.introspector == nil {
+			continue
+		}
+
+		reqClaims, err := item.verifier.introspectToken(ctx, token, item.config.CustomMapping)
+		if err != nil {
+			introspectionErrors = append(introspectionErrors, fmt.Errorf("idp %s: %w", item.config.Description, err))
+			zap.L().Debug("error introspecting token, trying next idp", zap.String("idp", item.config.Description), zap.Error(err))
+			continue
+		}
+
+		err = item.verifier.validateAgainstSpec(reqClaims, item.config.ValidationSpec)
+		if err != nil {
+			introspectionErrors = append(introspectionErrors, fmt.Errorf("idp %s validation: %w", item.config.Description, err))
+			zap.L().Debug("failed checks in idp validation", zap.Error(err))
+			continue
+		}
+
+		return reqClaims, &item, nil, nil
+	}
+
+	if len(introspectionErrors) == 0 {
+		return nil, nil, nil, errors.New("token is not a jwt and no idp has introspection enabled")
+	}
+	return nil, nil, nil, fmt.Errorf("no idp accepted opaque token: %w", errors.Join(introspectionErrors...))
+}
+
 type IdpJwtVerifier struct {
 	ctx *Context
 	*oidc.IDTokenVerifier
-	provider         *oidc.Provider
-	issuerURL        string
-	MaxTokenLifetime time.Duration
-	ClockSkew        time.Duration
+	provider          *oidc.Provider
+	issuerURL         string
+	clientIDs         []string
+	introspector      *tokenIntrospector
+	clientCert        *clientCertVerifier
+	passwordGrant     *passwordGrant
+	refresher         *tokenRefresher
+	userInfoCache     *userInfoCache
+	spiffeTrustDomain string
+	assertions        []claimAssertion
+	enrichment        []*enrichmentStage
+	transforms        []claimTransform
+	distributedClaims *distributedClaims
+	keySet            oidc.KeySet // nil for verifiers that do not verify tokens by signature
+	algorithms        []string
+	MaxTokenLifetime  time.Duration
+	ClockSkew         time.Duration
 }
 
 const oidcTimeout = 30 * time.Second
@@ -89,7 +396,12 @@ const (
 	DefaultClockSkew        = 5 * time.Minute
 )
 
-func NewJwtVerifier(ctx *Context, clientID string, issuerURL string, maxTokenLifetime time.Duration, clockSkew time.Duration) (*IdpJwtVerifier, error) {
+// NewJwtVerifier creates a verifier for an IDP found by OIDC discovery. Its
+// signing keys are fetched from the discovered jwks_uri and refreshed as
+// configured in jwks; idpName labels the key set's metrics. Tokens must have
+// one of clientIDs as an audience. When no algorithms are given, those the IDP
+// advertises are accepted.
+func NewJwtVerifier(ctx *Context, idpName string, clientIDs []string, issuerURL string, jwks IdpJwksConfig, maxTokenLifetime time.Duration, clockSkew time.Duration, algorithms []string) (*IdpJwtVerifier, error) {
 	if maxTokenLifetime <= 0 {
 		maxTokenLifetime = DefaultMaxTokenLifetime
 	}
@@ -106,21 +418,115 @@ func NewJwtVerifier(ctx *Context, clientID string, issuerURL string, maxTokenLif
 		return nil, err
 	}
 
+	var discovery struct {
+		JwksURL    string   `json:"jwks_uri"`
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, fmt.Errorf("error parsing discovery document: %w", err)
+	}
+	if discovery.JwksURL == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	if len(algorithms) == 0 {
+		algorithms = supportedJwsAlgorithms(discovery.Algorithms)
+	}
+
 	if ctx.Options.LogSensitive {
-		zap.L().Debug("NewJwtVerifier config-params", zap.String("client_id", clientID), zap.String("issuer_url", issuerURL),
-			zap.Duration("max_token_lifetime", maxTokenLifetime), zap.Duration("clock_skew", clockSkew))
+		zap.L().Debug("NewJwtVerifier config-params", zap.Strings("client_ids", clientIDs), zap.String("issuer_url", issuerURL),
+			zap.String("jwks_uri", discovery.JwksURL), zap.Duration("max_token_lifetime", maxTokenLifetime), zap.Duration("clock_skew", clockSkew))
 	}
 
+	keySet := newRemoteKeySet(idpName, discovery.JwksURL, jwks, ctx.Metrics)
+
 	return &IdpJwtVerifier{
 		ctx:              ctx,
-		IDTokenVerifier:  provider.Verifier(&oidc.Config{ClientID: clientID}),
+		IDTokenVerifier:  oidc.NewVerifier(issuerURL, keySet, &oidc.Config{SkipClientIDCheck: true, SupportedSigningAlgs: algorithms}),
 		provider:         provider,
 		issuerURL:        issuerURL,
+		clientIDs:        clientIDs,
+		keySet:           keySet,
+		algorithms:       algorithms,
 		MaxTokenLifetime: maxTokenLifetime,
 		ClockSkew:        clockSkew,
 	}, nil
 }
 
+// NewStaticJwtVerifier creates a verifier that checks tokens against a fixed key
+// set and expected issuer. It never makes network calls, so UserInfo lookups
+// are unavailable for verifiers created this way.
+func NewStaticJwtVerifier(ctx *Context, clientIDs []string, issuerURL string, keySet oidc.KeySet, maxTokenLifetime time.Duration, clockSkew time.Duration, algorithms []string) *IdpJwtVerifier {
+	if maxTokenLifetime <= 0 {
+		maxTokenLifetime = DefaultMaxTokenLifetime
+	}
+	if clockSkew <= 0 {
+		clockSkew = DefaultClockSkew
+	}
+
+	if ctx.Options.LogSensitive {
+		zap.L().Debug("NewStaticJwtVerifier config-params", zap.Strings("client_ids", clientIDs), zap.String("issuer_url", issuerURL),
+			zap.Duration("max_token_lifetime", maxTokenLifetime), zap.Duration("clock_skew", clockSkew))
+	}
+
+	return &IdpJwtVerifier{
+		ctx:              ctx,
+		IDTokenVerifier:  oidc.NewVerifier(issuerURL, keySet, &oidc.Config{SkipClientIDCheck: true, SupportedSigningAlgs: algorithms}),
+		issuerURL:        issuerURL,
+		clientIDs:        clientIDs,
+		keySet:           keySet,
+		algorithms:       algorithms,
+		MaxTokenLifetime: maxTokenLifetime,
+		ClockSkew:        clockSkew,
+	}
+}
+
+// NewSpiffeJwtVerifier creates a verifier for JWT-SVIDs issued in trustDomain
+// and signed by a key from its trust bundle. JWT-SVIDs carry no fixed issuer,
+// so the token's 'sub' SPIFFE ID must belong to trustDomain instead.
+func NewSpiffeJwtVerifier(ctx *Context, clientIDs []string, trustDomain string, keySet oidc.KeySet, maxTokenLifetime time.Duration, clockSkew time.Duration, algorithms []string) *IdpJwtVerifier {
+	if maxTokenLifetime <= 0 {
+		maxTokenLifetime = DefaultMaxTokenLifetime
+	}
+	if clockSkew <= 0 {
+		clockSkew = DefaultClockSkew
+	}
+
+	if len(algorithms) == 0 {
+		algorithms = spiffeSigningAlgs
+	}
+
+	issuerURL := spiffeScheme + "://" + trustDomain
+	if ctx.Options.LogSensitive {
+		zap.L().Debug("NewSpiffeJwtVerifier config-params", zap.Strings("client_ids", clientIDs), zap.String("trust_domain", trustDomain),
+			zap.Duration("max_token_lifetime", maxTokenLifetime), zap.Duration("clock_skew", clockSkew))
+	}
+
+	return &IdpJwtVerifier{
+		ctx: ctx,
+		IDTokenVerifier: oidc.NewVerifier(issuerURL, keySet, &oidc.Config{
+			SkipClientIDCheck:    true,
+			SupportedSigningAlgs: algorithms,
+			SkipIssuerCheck:      true,
+		}),
+		issuerURL:         issuerURL,
+		clientIDs:         clientIDs,
+		spiffeTrustDomain: trustDomain,
+		MaxTokenLifetime:  maxTokenLifetime,
+		ClockSkew:         clockSkew,
+	}
+}
+
+// NewClientCertVerifier creates a verifier for an IDP that identifies clients
+// by their TLS client certificate. It cannot verify tokens.
+func NewClientCertVerifier(ctx *Context, clientCert *clientCertVerifier) *IdpJwtVerifier {
+	return &IdpJwtVerifier{
+		ctx:              ctx,
+		clientCert:       clientCert,
+		MaxTokenLifetime: DefaultMaxTokenLifetime,
+		ClockSkew:        DefaultClockSkew,
+	}
+}
+
 // Verifies that the ID token was signed by idp and is valid.
 // Returns the claims embedded with the token
 func (v *IdpJwtVerifier) verifyJWT(ctx context.Context, token string, customMapping map[string]string) (*IdpJwtClaims, *oidc.IDToken, error) {
@@ -149,9 +555,29 @@ func (v *IdpJwtVerifier) verifyJWT(ctx context.Context, token string, customMapp
 		return nil, nil, err
 	}
 
+	if v.spiffeTrustDomain != "" {
+		id, err := parseSpiffeID(idToken.Subject)
+		if err != nil {
+			return nil, nil, err
+		}
+		if id.trustDomain != v.spiffeTrustDomain {
+			return nil, nil, fmt.Errorf("spiffe id %q is not in trust domain %q", id.raw, v.spiffeTrustDomain)
+		}
+		for k, val := range id.claims() {
+			rawClaims[k] = val
+		}
+	}
+
 	// Store all claims in CustomClaims using the custom mapping
 	claims.fromMap(rawClaims, customMapping)
 
+	azp, _ := rawClaims["azp"].(string)
+	clientID, ok := v.matchClientID(idToken.Audience, azp)
+	if !ok {
+		return nil, nil, fmt.Errorf("expected audience in %q got %q", v.clientIDs, idToken.Audience)
+	}
+	claims.IdpClientID = clientID
+
 	err = v.ValidateTimes(idToken.IssuedAt, idToken.Expiry)
 	if err != nil {
 		return nil, nil, err
@@ -160,8 +586,67 @@ func (v *IdpJwtVerifier) verifyJWT(ctx context.Context, token string, customMapp
 	return claims, idToken, nil
 }
 
+// introspectToken resolves an opaque token through the IDP's introspection
+// endpoint and returns its claims.
+func (v *IdpJwtVerifier) introspectToken(ctx context.Context, token string, customMapping map[string]string) (*IdpJwtClaims, error) {
+	if v.ctx.Options.LogSensitive {
+		zap.L().Debug("IntrospectToken", zap.String("token", token))
+	}
+
+	introspectCtx, introspectCancel := context.WithTimeout(ctx, oidcTimeout)
+	defer introspectCancel()
+
+	rawClaims, err := v.introspector.introspect(introspectCtx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, ok := rawClaims["iss"].(string); ok && iss != v.issuerURL {
+		return nil, fmt.Errorf("introspected token issued by %q, expected %q", iss, v.issuerURL)
+	}
+
+	claims := &IdpJwtClaims{}
+	claims.fromMap(rawClaims, customMapping)
+
+	// An introspection endpoint may serve several clients, so the token must
+	// have been issued to, or for, one of ours.
+	if slices.Contains(v.clientIDs, claims.ClientID) {
+		claims.IdpClientID = claims.ClientID
+	} else if clientID, ok := v.matchClientID(claims.Audience, ""); ok {
+		claims.IdpClientID = clientID
+	} else {
+		return nil, fmt.Errorf("introspected token was issued to client %q for audience %v, expected one of %v", claims.ClientID, claims.Audience, v.clientIDs)
+	}
+
+	now := time.Now()
+	if claims.Expiry > now.Unix()+int64(v.MaxTokenLifetime.Seconds()) {
+		return nil, errors.New("expiry too far in future")
+	}
+	if now.Unix() > claims.Expiry+int64(v.ClockSkew.Seconds()) {
+		return nil, errors.New("token used too late. check clock skew?")
+	}
+
+	return claims, nil
+}
+
+// matchClientID returns the accepted client id the token was issued for: azp
+// when it is accepted and among the audiences, otherwise the first accepted
+// audience.
+func (v *IdpJwtVerifier) matchClientID(audience []string, azp string) (string, bool) {
+	if azp != "" && slices.Contains(v.clientIDs, azp) && slices.Contains(audience, azp) {
+		return azp, true
+	}
+	for _, aud := range audience {
+		if slices.Contains(v.clientIDs, aud) {
+			return aud, true
+		}
+	}
+	return "", false
+}
+
 func (v *IdpJwtVerifier) ValidateTimes(issuedAt time.Time, expiry time.Time) error {
-	if issuedAt.Unix() < 1 {
+	// 'iat' is optional for JWT-SVIDs
+	if issuedAt.Unix() < 1 && v.spiffeTrustDomain == "" {
 		return errors.New("missing 'issued at' time in token")
 	}
 
@@ -211,10 +696,35 @@ func (v *IdpJwtVerifier) validateAgainstSpec(claims *IdpJwtClaims, spec IdpJwtVa
 		}
 	}
 
+	// go-oidc already rejects an 'nbf' more than 5 minutes ahead; this
+	// narrows the allowance to the configured clock skew.
+	if spec.EnforceNotBefore && claims.NotBeforeTime > 0 {
+		if time.Now().Unix() < claims.NotBeforeTime-int64(v.ClockSkew.Seconds()) {
+			return errors.New("token used before its 'nbf' time. check clock skew?")
+		}
+	}
+
+	if spec.ValidateAzp {
+		err := claims.validateAuthorizedParty(v.clientIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := checkAssertions(v.assertions, claims)
+	if err != nil {
+		zap.L().Debug("failed idp assertion", zap.Error(err))
+		return err
+	}
+
 	return nil
 }
 
 func (v *IdpJwtVerifier) GetUserInfo(ctx context.Context, accessToken string, idToken *oidc.IDToken) (map[string]interface{}, error) {
+	if v.provider == nil {
+		return nil, fmt.Errorf("user info is not available for an idp without discovery")
+	}
+
 	// Parse and verify the ID token
 	if accessToken == "" {
 		return nil, fmt.Errorf("no access token found in claim sources")
@@ -229,6 +739,17 @@ func (v *IdpJwtVerifier) GetUserInfo(ctx context.Context, accessToken string, id
 		return nil, fmt.Errorf("access token verification failed: %w", err)
 	}
 
+	if v.userInfoCache != nil {
+		key := v.userInfoCache.key(accessToken, idToken.Subject)
+		return v.userInfoCache.get(ctx, key, func(ctx context.Context) (map[string]interface{}, error) {
+			return v.fetchUserInfo(ctx, accessToken)
+		})
+	}
+	return v.fetchUserInfo(ctx, accessToken)
+}
+
+// fetchUserInfo requests the claims for accessToken from the UserInfo endpoint.
+func (v *IdpJwtVerifier) fetchUserInfo(ctx context.Context, accessToken string) (map[string]interface{}, error) {
 	// Use the verified access token to fetch user info
 	userInfo, err := v.provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{
 		AccessToken: accessToken,
@@ -2,9 +2,17 @@ package broker
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -124,6 +132,101 @@ func TestIdpJwtVerifier_ValidateAgainstSpec(t *testing.T) {
 	}
 }
 
+func TestIdpJwtVerifier_ValidateAgainstSpec_TokenChecks(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name          string
+		claims        map[string]interface{}
+		spec          IdpJwtValidationSpec
+		shouldSucceed bool
+	}{
+		{name: "nbf ignored by default", claims: map[string]interface{}{"nbf": now + 3600}, shouldSucceed: true},
+		{name: "nbf in future", claims: map[string]interface{}{"nbf": now + 3600}, spec: IdpJwtValidationSpec{EnforceNotBefore: true}},
+		{name: "nbf within skew", claims: map[string]interface{}{"nbf": now + 30}, spec: IdpJwtValidationSpec{EnforceNotBefore: true}, shouldSucceed: true},
+		{name: "nbf in past", claims: map[string]interface{}{"nbf": now - 60}, spec: IdpJwtValidationSpec{EnforceNotBefore: true}, shouldSucceed: true},
+		{name: "single audience without azp", claims: map[string]interface{}{"aud": "nats"}, spec: IdpJwtValidationSpec{ValidateAzp: true}, shouldSucceed: true},
+		{name: "multiple audiences without azp", claims: map[string]interface{}{"aud": []interface{}{"nats", "web"}}, spec: IdpJwtValidationSpec{ValidateAzp: true}},
+		{name: "multiple audiences with azp", claims: map[string]interface{}{"aud": []interface{}{"nats", "web"}, "azp": "nats"}, spec: IdpJwtValidationSpec{ValidateAzp: true}, shouldSucceed: true},
+		{name: "azp for another client", claims: map[string]interface{}{"aud": "nats", "azp": "web"}, spec: IdpJwtValidationSpec{ValidateAzp: true}},
+		{name: "azp ignored by default", claims: map[string]interface{}{"aud": []interface{}{"nats", "web"}}, shouldSucceed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := &IdpJwtVerifier{clientIDs: []string{"nats"}, ClockSkew: time.Minute}
+			claims := &IdpJwtClaims{}
+			claims.fromMap(tt.claims, nil)
+			err := verifier.validateAgainstSpec(claims, tt.spec)
+			if tt.shouldSucceed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckTokenType(t *testing.T) {
+	withHeader := func(header string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(header)) + ".e30.sig"
+	}
+
+	assert.NoError(t, checkTokenType(withHeader(`{"alg":"RS256"}`), ""))
+	assert.NoError(t, checkTokenType(withHeader(`{"alg":"RS256","typ":"JWT"}`), "JWT"))
+	assert.NoError(t, checkTokenType(withHeader(`{"alg":"RS256","typ":"application/jwt"}`), "jwt"))
+	assert.Error(t, checkTokenType(withHeader(`{"alg":"RS256","typ":"at+jwt"}`), "JWT"))
+	assert.Error(t, checkTokenType(withHeader(`{"alg":"RS256"}`), "JWT"))
+	assert.Error(t, checkTokenType("%%%.e30.sig", "JWT"))
+}
+
+func TestRunVerification_Algorithms(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signer.key.PublicKey}}
+	token := signer.mint(t, map[string]interface{}{"iss": "https://a.example", "aud": "nats", "sub": "alice"})
+
+	verify := func(spec IdpJwtValidationSpec) error {
+		idp := &Idp{Description: "a", IssuerURL: "https://a.example", ClientID: "nats", ValidationSpec: spec}
+		verifier := NewStaticJwtVerifier(NewServerContext(nil), idp.clientIDs(), idp.IssuerURL, keySet, 0, 0, spec.Algorithms)
+		_, _, _, err := runVerification(context.Background(), token, []IdpAndJwtVerifier{{verifier, idp}})
+		return err
+	}
+
+	assert.NoError(t, verify(IdpJwtValidationSpec{}))
+	assert.NoError(t, verify(IdpJwtValidationSpec{Algorithms: []string{"ES256", "RS256"}, Typ: "JWT"}))
+	assert.ErrorContains(t, verify(IdpJwtValidationSpec{Algorithms: []string{"ES256"}}), `unexpected signature algorithm "RS256"`)
+	assert.ErrorContains(t, verify(IdpJwtValidationSpec{Typ: "at+jwt"}), "'typ' header")
+}
+
+func TestRunVerification_ClientIDs(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signer.key.PublicKey}}
+	idp := &Idp{Description: "keycloak", IssuerURL: "https://a.example", ClientID: "web", ClientIDs: []string{"cli", "mobile", "web"}}
+	require.Equal(t, []string{"web", "cli", "mobile"}, idp.clientIDs())
+	verifiers := []IdpAndJwtVerifier{{NewStaticJwtVerifier(NewServerContext(nil), idp.clientIDs(), idp.IssuerURL, keySet, 0, 0, nil), idp}}
+
+	verify := func(claims map[string]interface{}) (*IdpJwtClaims, error) {
+		claims["iss"] = "https://a.example"
+		claims["sub"] = "alice"
+		reqClaims, _, _, err := runVerification(context.Background(), signer.mint(t, claims), verifiers)
+		return reqClaims, err
+	}
+
+	claims, err := verify(map[string]interface{}{"aud": "cli"})
+	require.NoError(t, err)
+	assert.Equal(t, "cli", claims.IdpClientID)
+
+	claims, err = verify(map[string]interface{}{"aud": []interface{}{"account", "mobile"}})
+	require.NoError(t, err)
+	assert.Equal(t, "mobile", claims.IdpClientID)
+
+	claims, err = verify(map[string]interface{}{"aud": []interface{}{"web", "cli"}, "azp": "cli"})
+	require.NoError(t, err)
+	assert.Equal(t, "cli", claims.IdpClientID, "azp should select the matched client id")
+
+	_, err = verify(map[string]interface{}{"aud": "admin-console"})
+	assert.ErrorContains(t, err, "expected audience in")
+}
+
 func TestIdpJwtVerifier_ValidateTimes(t *testing.T) {
 	verifier := &IdpJwtVerifier{
 		MaxTokenLifetime: 24 * time.Hour,
@@ -330,3 +433,164 @@ func TestNewIdpVerifiers(t *testing.T) {
 		})
 	}
 }
+
+// mockOIDCProvider serves OIDC discovery and JWKS documents for a testSigner.
+// Further endpoints can be registered on mux by individual tests.
+type mockOIDCProvider struct {
+	server      *httptest.Server
+	mux         *http.ServeMux
+	signer      *testSigner
+	unavailable atomic.Bool // when true, discovery responds with 503
+	discovery   map[string]interface{}
+}
+
+func newMockOIDCProvider(t *testing.T, signer *testSigner) *mockOIDCProvider {
+	t.Helper()
+
+	m := &mockOIDCProvider{mux: http.NewServeMux(), signer: signer}
+	m.server = httptest.NewServer(m.mux)
+	t.Cleanup(m.server.Close)
+
+	m.discovery = map[string]interface{}{
+		"issuer":                                m.server.URL,
+		"jwks_uri":                              m.server.URL + "/jwks",
+		"token_endpoint":                        m.server.URL + "/token",
+		"userinfo_endpoint":                     m.server.URL + "/userinfo",
+		"introspection_endpoint":                m.server.URL + "/introspect",
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"response_types_supported":              []string{"id_token"},
+	}
+
+	m.mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		if m.unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m.discovery)
+	})
+	m.mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(m.signer.jwksJSON(t))
+	})
+
+	return m
+}
+
+// issuer returns the issuer URL of the mock provider.
+func (m *mockOIDCProvider) issuer() string {
+	return m.server.URL
+}
+
+// mint signs an ID token issued by the mock provider.
+func (m *mockOIDCProvider) mint(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	all := map[string]interface{}{"iss": m.issuer()}
+	for k, v := range claims {
+		all[k] = v
+	}
+	return m.signer.mint(t, all)
+}
+
+func TestNewIdpVerifiers_Discovery(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	down := newMockOIDCProvider(t, newTestSigner(t, "k2"))
+	down.unavailable.Store(true)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "up", IssuerURL: provider.issuer(), ClientID: "nats"},
+			{Description: "down", IssuerURL: down.issuer(), ClientID: "nats", IgnoreSetupError: true},
+		},
+	}
+
+	verifiers, pending, err := newIdpVerifierSet(NewServerContext(nil), config)
+	require.NoError(t, err)
+	require.Len(t, verifiers, 1)
+	assert.Equal(t, "up", verifiers[0].config.Description)
+	require.Len(t, pending, 1)
+	assert.Same(t, &config.Idp[1], pending[0])
+
+	token := provider.mint(t, map[string]interface{}{"aud": "nats", "sub": "alice"})
+	claims, _, _, err := runVerification(context.Background(), token, verifiers)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+}
+
+func TestRunVerification_IssuerRouting(t *testing.T) {
+	signerA := newTestSigner(t, "a")
+	signerB := newTestSigner(t, "b")
+	ctx := NewServerContext(nil)
+
+	staticIdp := func(desc, issuer, clientID string, signer *testSigner) IdpAndJwtVerifier {
+		keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signer.key.PublicKey}}
+		return IdpAndJwtVerifier{
+			verifier: NewStaticJwtVerifier(ctx, []string{clientID}, issuer, keySet, 0, 0, nil),
+			config:   &Idp{Description: desc, IssuerURL: issuer, ClientID: clientID},
+		}
+	}
+
+	verifiers := []IdpAndJwtVerifier{
+		staticIdp("a", "https://a.example", "nats", signerA),
+		staticIdp("b-web", "https://b.example", "web", signerB),
+		staticIdp("b-cli", "https://b.example", "cli", signerB),
+	}
+
+	t.Run("routes by issuer", func(t *testing.T) {
+		token := signerA.mint(t, map[string]interface{}{"iss": "https://a.example", "aud": "nats", "sub": "alice"})
+		claims, matched, _, err := runVerification(context.Background(), token, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, "a", matched.config.Description)
+	})
+
+	t.Run("unknown issuer", func(t *testing.T) {
+		token := signerA.mint(t, map[string]interface{}{"iss": "https://c.example", "aud": "nats"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.EqualError(t, err, `no idp configured for issuer "https://c.example"`)
+	})
+
+	t.Run("shared issuer narrowed by audience", func(t *testing.T) {
+		token := signerB.mint(t, map[string]interface{}{"iss": "https://b.example", "aud": "cli", "sub": "bob"})
+		candidates, err := routeVerifiers(token, verifiers)
+		require.NoError(t, err)
+		require.Len(t, candidates, 1)
+		assert.Equal(t, "b-cli", candidates[0].config.Description)
+
+		_, matched, _, err := runVerification(context.Background(), token, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "b-cli", matched.config.Description)
+	})
+
+	t.Run("shared issuer narrowed by azp", func(t *testing.T) {
+		token := signerB.mint(t, map[string]interface{}{"iss": "https://b.example", "aud": "account", "azp": "web"})
+		candidates, err := routeVerifiers(token, verifiers)
+		require.NoError(t, err)
+		require.Len(t, candidates, 1)
+		assert.Equal(t, "b-web", candidates[0].config.Description)
+	})
+
+	t.Run("shared issuer falls back to trial", func(t *testing.T) {
+		token := signerB.mint(t, map[string]interface{}{"iss": "https://b.example", "aud": "other"})
+		candidates, err := routeVerifiers(token, verifiers)
+		require.NoError(t, err)
+		assert.Len(t, candidates, 2)
+
+		_, _, _, err = runVerification(context.Background(), token, verifiers)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "idp b-web")
+		assert.Contains(t, err.Error(), "idp b-cli")
+		assert.NotContains(t, err.Error(), "idp a:")
+	})
+
+	t.Run("malformed token", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "not.a.jwt", verifiers)
+		assert.ErrorContains(t, err, "malformed jwt")
+	})
+
+	t.Run("no verifiers", func(t *testing.T) {
+		_, _, _, err := runVerification(context.Background(), "not-a-jwt", nil)
+		assert.EqualError(t, err, "no idp verifiers configured")
+	})
+}
@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"github.com/nats-io/jwt/v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultPasswordGrantPerUser  = 5
+	defaultPasswordGrantGlobal   = 50
+	defaultPasswordGrantInterval = time.Minute
+)
+
+var (
+	errPasswordGrantRateLimited = errors.New("password grant rate limit exceeded")
+	errInvalidCredentials       = errors.New("invalid username or password")
+)
+
+// passwordGrant exchanges usernames and passwords for tokens at an IDP's token
+// endpoint, subject to per-user and global rate limits.
+type passwordGrant struct {
+	oauth oauth2.Config
+
+	mu       sync.Mutex // serialises limiter lookup and creation
+	global   *rate.Limiter
+	perUser  *ttlCache[*rate.Limiter]
+	limit    rate.Limit
+	burst    int
+	interval time.Duration
+}
+
+func newPasswordGrant(cfg PasswordGrantConfig, clientID string, clientSecret string, tokenURL string) *passwordGrant {
+	perUser := cfg.RateLimit.PerUser
+	if perUser <= 0 {
+		perUser = defaultPasswordGrantPerUser
+	}
+	global := cfg.RateLimit.Global
+	if global <= 0 {
+		global = defaultPasswordGrantGlobal
+	}
+	interval := cfg.RateLimit.Interval.Duration
+	if interval <= 0 {
+		interval = defaultPasswordGrantInterval
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID}
+	}
+
+	return &passwordGrant{
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+			Scopes:       scopes,
+		},
+		global:   rate.NewLimiter(rate.Every(interval/time.Duration(global)), global),
+		perUser:  newTTLCache[*rate.Limiter](0),
+		limit:    rate.Every(interval / time.Duration(perUser)),
+		burst:    perUser,
+		interval: interval,
+	}
+}
+
+// allow reports whether another attempt for username is permitted. Attempts
+// count against the limits whether or not they succeed. When the limiters
+// of other users fill the cache, new usernames are refused rather than
+// evicting a live limiter, which would reset that user's limit.
+func (p *passwordGrant) allow(username string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.ToLower(username)
+	limiter, ok := p.perUser.get(key)
+	if !ok {
+		limiter = rate.NewLimiter(p.limit, p.burst)
+	}
+	// An idle limiter refills completely within one interval, so it can be
+	// dropped once the interval has passed without attempts.
+	if !p.perUser.trySet(key, limiter, time.Now().Add(p.interval)) {
+		return false
+	}
+
+	return limiter.Allow() && p.global.Allow()
+}
+
+// exchange redeems username and password for tokens. The returned request
+// carries the ID token to verify.
+func (p *passwordGrant) exchange(ctx context.Context, username string, password string) (TokenRequest, error) {
+	if !p.allow(username) {
+		return TokenRequest{}, errPasswordGrantRateLimited
+	}
+
+	exchangeCtx, exchangeCancel := context.WithTimeout(ctx, oidcTimeout)
+	defer exchangeCancel()
+
+	token, err := p.oauth.PasswordCredentialsToken(exchangeCtx, username, password)
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && (retrieveErr.ErrorCode == "invalid_grant" ||
+			(retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized)) {
+			return TokenRequest{}, errInvalidCredentials
+		}
+		return TokenRequest{}, fmt.Errorf("password grant failed: %w", err)
+	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return TokenRequest{}, errors.New("token response has no id_token; check the password_grant scopes include openid")
+	}
+
+	return TokenRequest{
+		AccessToken:  token.AccessToken,
+		IDToken:      idToken,
+		RefreshToken: token.RefreshToken,
+		TokenType:    token.TokenType,
+	}, nil
+}
+
+// passwordGrantResult classifies a password grant error for metrics and audit.
+func passwordGrantResult(err error) string {
+	switch {
+	case err == nil:
+		return metrics.StatusSuccess
+	case errors.Is(err, errInvalidCredentials):
+		return metrics.ResultInvalidCredentials
+	case errors.Is(err, errPasswordGrantRateLimited):
+		return metrics.ResultRateLimited
+	default:
+		return metrics.StatusError
+	}
+}
+
+// passwordGrantCredentials returns the username and password of a request
+// that should be authenticated with the password grant: one with a plain
+// username and password and no token.
+func passwordGrantCredentials(request *jwt.ConnectOptions) (string, string, bool) {
+	if request.Token != "" || request.Username == "" || request.Password == "" {
+		return "", "", false
+	}
+	if isCompactJWT(request.Password) {
+		return "", "", false
+	}
+	var tokenReq TokenRequest
+	if json.Unmarshal([]byte(request.Password), &tokenReq) == nil {
+		return "", "", false
+	}
+	return request.Username, request.Password, true
+}
+
+// hasPasswordGrant reports whether any IDP accepts the password grant.
+func hasPasswordGrant(items []IdpAndJwtVerifier) bool {
+	for _, item := range items {
+		if item.verifier.passwordGrant != nil {
+			return true
+		}
+	}
+	return false
+}
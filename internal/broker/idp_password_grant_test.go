@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"github.com/nats-io/jwt/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// handlePasswordGrant registers a token endpoint on the mock provider that
+// issues an ID token with claims when given the expected username and password.
+func (m *mockOIDCProvider) handlePasswordGrant(t *testing.T, username, password string, claims map[string]interface{}) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	m.mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("grant_type") != "password" || r.PostFormValue("username") != username || r.PostFormValue("password") != password {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     m.mint(t, claims),
+		})
+	})
+	return &calls
+}
+
+func TestPasswordGrantCredentials(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts jwt.ConnectOptions
+		ok   bool
+	}{
+		{name: "username and password", opts: jwt.ConnectOptions{Username: "alice", Password: "hunter2"}, ok: true},
+		{name: "token present", opts: jwt.ConnectOptions{Username: "alice", Password: "hunter2", Token: "t"}},
+		{name: "no username", opts: jwt.ConnectOptions{Password: "hunter2"}},
+		{name: "jwt in password", opts: jwt.ConnectOptions{Username: "alice", Password: "a.b.c"}},
+		{name: "token request in password", opts: jwt.ConnectOptions{Username: "alice", Password: `{"id_token":"a.b.c"}`}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, ok := passwordGrantCredentials(&tc.opts)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestPasswordGrant_RateLimit(t *testing.T) {
+	grant := newPasswordGrant(PasswordGrantConfig{
+		RateLimit: PasswordGrantRateLimit{PerUser: 2, Global: 3, Interval: Duration{time.Hour}},
+	}, "nats", "", "http://unused")
+
+	assert.True(t, grant.allow("alice"))
+	assert.True(t, grant.allow("Alice"), "usernames should be limited case-insensitively")
+	assert.False(t, grant.allow("alice"), "per-user limit should apply")
+
+	assert.True(t, grant.allow("bob"))
+	assert.False(t, grant.allow("carol"), "global limit should apply across users")
+}
+
+func TestPasswordGrant_RateLimitCacheFull(t *testing.T) {
+	grant := newPasswordGrant(PasswordGrantConfig{
+		RateLimit: PasswordGrantRateLimit{PerUser: 1, Global: 10, Interval: Duration{time.Hour}},
+	}, "nats", "", "http://unused")
+	grant.perUser = newTTLCache[*rate.Limiter](1)
+
+	assert.True(t, grant.allow("alice"))
+	assert.False(t, grant.allow("bob"), "new usernames should be refused while the cache is full")
+	assert.False(t, grant.allow("alice"), "alice's limiter should not be reset")
+}
+
+func TestValidatePasswordGrant(t *testing.T) {
+	enabled := PasswordGrantConfig{Enabled: true}
+
+	config := &Config{Idp: []Idp{{Description: "a"}, {Description: "b", PasswordGrant: enabled}}}
+	assert.NoError(t, config.validatePasswordGrant())
+
+	config.Idp[0].PasswordGrant = enabled
+	err := config.validatePasswordGrant()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "one idp only")
+}
+
+func TestVerifyPasswordGrant(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	calls := provider.handlePasswordGrant(t, "alice", "hunter2", map[string]interface{}{"aud": "nats", "sub": "alice", "email": "alice@example.com"})
+
+	config := &Config{
+		Service: Service{Name: "iam"},
+		Idp: []Idp{
+			{Description: "tokens only", IssuerURL: provider.issuer(), ClientID: "nats"},
+			{
+				Description: "legacy", IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s3cret",
+				PasswordGrant: PasswordGrantConfig{Enabled: true, RateLimit: PasswordGrantRateLimit{PerUser: 2, Interval: Duration{time.Hour}}},
+			},
+		},
+	}
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+	require.True(t, hasPasswordGrant(verifiers))
+	require.False(t, hasPasswordGrant(verifiers[:1]))
+
+	request := &jwt.AuthorizationRequestClaims{}
+	request.UserNkey = "UNKEY"
+
+	t.Run("valid credentials", func(t *testing.T) {
+		claims, matched, err := verifyPasswordGrant(context.Background(), nil, nil, config, "alice", "hunter2", verifiers, request)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+		assert.Equal(t, "alice@example.com", claims.Email)
+		assert.Equal(t, "legacy", matched.config.Description)
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		_, _, err := verifyPasswordGrant(context.Background(), nil, nil, config, "alice", "wrong", verifiers, request)
+		assert.ErrorIs(t, err, errInvalidCredentials)
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		before := calls.Load()
+		_, _, err := verifyPasswordGrant(context.Background(), nil, nil, config, "alice", "hunter2", verifiers, request)
+		assert.ErrorIs(t, err, errPasswordGrantRateLimited)
+		assert.Equal(t, before, calls.Load(), "rate limited attempts should not reach the idp")
+		assert.Equal(t, metrics.ResultRateLimited, passwordGrantResult(err))
+	})
+}
+
+func TestPublishAttemptEvent(t *testing.T) {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	require.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	config := &Config{Service: Service{Name: "iam"}}
+	sub, err := nc.SubscribeSync(passwordGrantFailedSubject(config))
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	request := &jwt.AuthorizationRequestClaims{}
+	request.UserNkey = "UNKEY"
+	request.ConnectOptions.Username = "alice"
+	request.ConnectOptions.Password = "hunter2"
+	request.ClientInformation.Host = "10.0.0.7"
+
+	publishAttemptEvent(context.Background(), nc, passwordGrantFailedSubject(config), request, "legacy", metrics.ResultInvalidCredentials)
+	require.NoError(t, nc.Flush())
+
+	msg, err := sub.NextMsg(2 * time.Second)
+	require.NoError(t, err)
+	assert.NotContains(t, string(msg.Data), "hunter2")
+
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "legacy", event["idp"])
+	assert.Equal(t, metrics.ResultInvalidCredentials, event["result"])
+	assert.Equal(t, "alice", event["username"])
+	assert.Equal(t, "UNKEY", event["user_pub_nkey"])
+	assert.Equal(t, "10.0.0.7", event["client_host"])
+}
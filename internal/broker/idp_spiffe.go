@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	spiffeScheme = "spiffe"
+
+	// spiffeJwtSvidUse is the JWK 'use' of keys that sign JWT-SVIDs in a
+	// SPIFFE trust bundle.
+	spiffeJwtSvidUse = "jwt-svid"
+)
+
+// spiffeSigningAlgs are the JWT-SVID signature algorithms permitted by the
+// SPIFFE specification.
+var spiffeSigningAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+}
+
+// spiffeID is a parsed SPIFFE ID of the form spiffe://<trust-domain>/<path>.
+type spiffeID struct {
+	raw         string
+	trustDomain string
+	path        string
+	segments    []string
+}
+
+// parseSpiffeID parses and validates a SPIFFE ID.
+func parseSpiffeID(raw string) (*spiffeID, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spiffe id %q: %w", raw, err)
+	}
+	if u.Scheme != spiffeScheme {
+		return nil, fmt.Errorf("invalid spiffe id %q: scheme must be %q", raw, spiffeScheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid spiffe id %q: missing trust domain", raw)
+	}
+	if u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid spiffe id %q: must not have user info, port, query or fragment", raw)
+	}
+
+	var segments []string
+	if trimmed := strings.Trim(u.Path, "/"); trimmed != "" {
+		segments = strings.Split(trimmed, "/")
+	}
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid spiffe id %q: path has empty or relative segments", raw)
+		}
+	}
+
+	return &spiffeID{
+		raw:         raw,
+		trustDomain: u.Host,
+		path:        u.Path,
+		segments:    segments,
+	}, nil
+}
+
+// spiffeTrustDomainOf returns the trust domain of a spiffe:// issuer_url, or
+// an empty string if issuerURL does not use the spiffe scheme.
+func spiffeTrustDomainOf(issuerURL string) string {
+	if !strings.HasPrefix(issuerURL, spiffeScheme+"://") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(issuerURL, spiffeScheme+"://"), "/")
+}
+
+// claims returns the claims added to a verified JWT-SVID so that role
+// bindings and templates can match on the workload identity.
+func (id *spiffeID) claims() map[string]interface{} {
+	segments := make([]interface{}, len(id.segments))
+	for i, segment := range id.segments {
+		segments[i] = segment
+	}
+	return map[string]interface{}{
+		"spiffe_id":            id.raw,
+		"spiffe_trust_domain":  id.trustDomain,
+		"spiffe_path":          id.path,
+		"spiffe_path_segments": segments,
+	}
+}
+
+// loadSpiffeBundle builds a key set from the JWT-SVID keys of a SPIFFE trust
+// bundle in JWKS format. X.509-SVID keys in the bundle are ignored.
+func loadSpiffeBundle(path string) (*oidc.StaticKeySet, error) {
+	if path == "" {
+		return nil, errors.New("spiffe.bundle_file is required for a spiffe idp")
+	}
+
+	keys, err := readJwksFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	svidKeys := make([]jose.JSONWebKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Use != spiffeJwtSvidUse {
+			zap.L().Debug("skipping bundle key not used for jwt-svids", zap.String("kid", key.KeyID), zap.String("use", key.Use))
+			continue
+		}
+		svidKeys = append(svidKeys, key)
+	}
+
+	return newStaticKeySet(svidKeys)
+}
@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSpiffeBundle writes a SPIFFE trust bundle holding the JWT-SVID keys of
+// signers, plus an X.509-SVID entry that must be ignored.
+func writeSpiffeBundle(t *testing.T, path string, signers ...*testSigner) {
+	t.Helper()
+	var keys []jose.JSONWebKey
+	for _, signer := range signers {
+		key := signer.jwk()
+		key.Use = spiffeJwtSvidUse
+		keys = append(keys, key)
+	}
+	x509Key := newTestSigner(t, "x509").jwk()
+	x509Key.Use = "x509-svid"
+	keys = append(keys, x509Key)
+
+	raw, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+}
+
+func TestParseSpiffeID(t *testing.T) {
+	testCases := []struct {
+		raw         string
+		trustDomain string
+		segments    []string
+		wantErr     bool
+	}{
+		{raw: "spiffe://example.org/ns/prod/sa/payments", trustDomain: "example.org", segments: []string{"ns", "prod", "sa", "payments"}},
+		{raw: "spiffe://example.org", trustDomain: "example.org"},
+		{raw: "https://example.org/ns/prod", wantErr: true},
+		{raw: "spiffe:///ns/prod", wantErr: true},
+		{raw: "spiffe://example.org:8443/ns", wantErr: true},
+		{raw: "spiffe://example.org/ns?x=1", wantErr: true},
+		{raw: "spiffe://example.org/ns//prod", wantErr: true},
+		{raw: "spiffe://example.org/ns/../prod", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.raw, func(t *testing.T) {
+			id, err := parseSpiffeID(tc.raw)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.trustDomain, id.trustDomain)
+			assert.Equal(t, tc.segments, id.segments)
+		})
+	}
+}
+
+func TestLoadSpiffeBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	writeSpiffeBundle(t, path, newTestSigner(t, "svid"))
+
+	keySet, err := loadSpiffeBundle(path)
+	require.NoError(t, err)
+	assert.Len(t, keySet.PublicKeys, 1, "x509-svid keys should be ignored")
+
+	_, err = loadSpiffeBundle("")
+	assert.ErrorContains(t, err, "bundle_file is required")
+}
+
+func TestSpiffeJwtSvidVerification(t *testing.T) {
+	signer := newTestSigner(t, "svid")
+	bundle := filepath.Join(t.TempDir(), "bundle.json")
+	writeSpiffeBundle(t, bundle, signer)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "workloads", IssuerURL: "spiffe://example.org", ClientID: "nats", ClientIDs: []string{"nats-jobs"}, Spiffe: IdpSpiffeConfig{BundleFile: bundle}},
+		},
+	}
+	assert.Equal(t, []string{bundle}, config.referencedFiles())
+
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+	require.Len(t, verifiers, 1)
+
+	t.Run("valid svid exposes spiffe claims", func(t *testing.T) {
+		// JWT-SVIDs may omit iat and need not carry an iss
+		token := signer.mint(t, map[string]interface{}{"sub": "spiffe://example.org/ns/prod/sa/payments", "aud": "nats", "iat": nil})
+		claims, matched, _, err := runVerification(context.Background(), token, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "workloads", matched.config.Description)
+		assert.Equal(t, "spiffe://example.org/ns/prod/sa/payments", claims.Subject)
+
+		claimsMap := claims.toMap()
+		assert.Equal(t, "spiffe://example.org/ns/prod/sa/payments", claimsMap["spiffe_id"])
+		assert.Equal(t, "example.org", claimsMap["spiffe_trust_domain"])
+		assert.Equal(t, "/ns/prod/sa/payments", claimsMap["spiffe_path"])
+		assert.Equal(t, []interface{}{"ns", "prod", "sa", "payments"}, claimsMap["spiffe_path_segments"])
+
+		account, _, _, _, err := (&Config{Rbac: Rbac{
+			RoleBinding: []RoleBinding{{Account: "payments", Match: []Match{{Claim: "spiffe_path_segments", Value: "payments"}}}},
+		}}).lookupUserAccount(claimsMap)
+		require.NoError(t, err)
+		assert.Equal(t, "payments", account)
+	})
+
+	t.Run("any configured client id is accepted", func(t *testing.T) {
+		token := signer.mint(t, map[string]interface{}{"sub": "spiffe://example.org/ns/batch/sa/jobs", "aud": "nats-jobs"})
+		claims, _, _, err := runVerification(context.Background(), token, verifiers)
+		require.NoError(t, err)
+		assert.Equal(t, "nats-jobs", claims.IdpClientID)
+	})
+
+	t.Run("other trust domain", func(t *testing.T) {
+		token := signer.mint(t, map[string]interface{}{"sub": "spiffe://other.org/ns/prod", "aud": "nats"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.EqualError(t, err, `no idp configured for spiffe trust domain "other.org"`)
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		token := signer.mint(t, map[string]interface{}{"sub": "spiffe://example.org/ns/prod", "aud": "other"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.Error(t, err)
+	})
+
+	t.Run("signed by untrusted key", func(t *testing.T) {
+		token := newTestSigner(t, "svid").mint(t, map[string]interface{}{"sub": "spiffe://example.org/ns/prod", "aud": "nats"})
+		_, _, _, err := runVerification(context.Background(), token, verifiers)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultIdpRetryInitialBackoff = 5 * time.Second
+	defaultIdpRetryMaxBackoff     = 5 * time.Minute
+)
+
+// IdpSupervisor retries setup of IDPs that failed at startup (or reload) with
+// ignore_setup_error enabled. Once an IDP comes up, its verifier is added to
+// the watcher's live state so that subsequent auth requests can use it.
+type IdpSupervisor struct {
+	ctx     *Context
+	watcher *ConfigWatcher
+	metrics *metrics.Metrics
+	health  *metrics.HealthChecker
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewIdpSupervisor creates a supervisor for the given watcher. The watcher
+// notifies the supervisor on every reload so that retries always target the
+// current configuration.
+func NewIdpSupervisor(ctx *Context, watcher *ConfigWatcher, m *metrics.Metrics, health *metrics.HealthChecker) *IdpSupervisor {
+	s := &IdpSupervisor{
+		ctx:            ctx,
+		watcher:        watcher,
+		metrics:        m,
+		health:         health,
+		initialBackoff: defaultIdpRetryInitialBackoff,
+		maxBackoff:     defaultIdpRetryMaxBackoff,
+	}
+	watcher.supervisor = s
+	return s
+}
+
+// Start begins retrying the IDPs pending in the watcher's current state.
+func (s *IdpSupervisor) Start() {
+	s.reset(s.watcher.State())
+}
+
+// Stop cancels all retries and waits for them to exit.
+func (s *IdpSupervisor) Stop() {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// reset cancels retries belonging to a previous state and starts retrying the
+// pending IDPs of state. It does not wait for cancelled retries to exit, as it
+// may be called while the watcher holds its reload lock.
+func (s *IdpSupervisor) reset(state *LiveState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	retryCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.reportStates(state)
+
+	for _, idp := range state.pendingIdps {
+		s.wg.Add(1)
+		go s.retry(retryCtx, state.config, idp)
+	}
+}
+
+// reportStates publishes the setup state of every IDP in state.
+func (s *IdpSupervisor) reportStates(state *LiveState) {
+	states := make(map[string]string, len(state.idpVerifiers)+len(state.pendingIdps))
+	for _, item := range state.idpVerifiers {
+		states[item.config.Description] = metrics.IDPStateActive
+	}
+	for _, idp := range state.pendingIdps {
+		states[idp.Description] = metrics.IDPStatePending
+	}
+
+	if s.metrics != nil {
+		s.metrics.IDPState.Reset()
+		for idp, st := range states {
+			s.metrics.SetIDPState(idp, st)
+		}
+	}
+	if s.health != nil {
+		s.health.SetIDPStates(states)
+		s.health.SetIDPVerifiersReady(len(state.idpVerifiers) > 0)
+	}
+}
+
+// setState reports the state of a single IDP, unless ctx has been cancelled by
+// a reset (in which case the IDP belongs to a superseded configuration).
+func (s *IdpSupervisor) setState(ctx context.Context, idp string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	if s.metrics != nil {
+		s.metrics.SetIDPState(idp, state)
+	}
+	if s.health != nil {
+		s.health.SetIDPState(idp, state)
+		if state == metrics.IDPStateActive {
+			s.health.SetIDPVerifiersReady(true)
+		}
+	}
+}
+
+// retry attempts setup of idp with exponential backoff until it succeeds or
+// ctx is cancelled. config identifies the configuration idp belongs to.
+func (s *IdpSupervisor) retry(ctx context.Context, config *Config, idp *Idp) {
+	defer s.wg.Done()
+
+	backoff := s.initialBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		verifier, err := newVerifierForIdp(s.ctx, idp)
+		if err != nil {
+			if s.metrics != nil {
+				s.metrics.IDPSetupAttempts.WithLabelValues(idp.Description, metrics.StatusError).Inc()
+			}
+			backoff = min(backoff*2, s.maxBackoff)
+			s.setState(ctx, idp.Description, metrics.IDPStateFailing)
+			zap.L().Warn("IDP setup retry failed",
+				zap.String("idp", idp.Description),
+				zap.String("issuer_url", idp.IssuerURL),
+				zap.Duration("next_retry", backoff),
+				zap.Error(err))
+			continue
+		}
+
+		if s.metrics != nil {
+			s.metrics.IDPSetupAttempts.WithLabelValues(idp.Description, metrics.StatusSuccess).Inc()
+		}
+
+		if !s.watcher.activateVerifier(config, IdpAndJwtVerifier{verifier, idp}) {
+			zap.L().Debug("discarding IDP verifier for superseded configuration", zap.String("idp", idp.Description))
+			return
+		}
+
+		s.setState(ctx, idp.Description, metrics.IDPStateActive)
+		zap.L().Info("IDP verifier activated after setup retry", zap.String("idp", idp.Description), zap.String("issuer_url", idp.IssuerURL))
+		return
+	}
+}
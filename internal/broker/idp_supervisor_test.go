@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSupervisedWatcher builds a watcher whose state holds the verifiers for
+// config, with a supervisor using short backoffs.
+func newSupervisedWatcher(t *testing.T, config *Config, health *metrics.HealthChecker) (*ConfigWatcher, *IdpSupervisor) {
+	t.Helper()
+
+	ctx := NewServerContext(nil)
+	verifiers, pending, err := newIdpVerifierSet(ctx, config)
+	require.NoError(t, err)
+
+	watcher := NewConfigWatcher(ctx, nil, &LiveState{
+		config:       config,
+		idpVerifiers: verifiers,
+		pendingIdps:  pending,
+	})
+	supervisor := NewIdpSupervisor(ctx, watcher, nil, health)
+	supervisor.initialBackoff = 10 * time.Millisecond
+	supervisor.maxBackoff = 50 * time.Millisecond
+	t.Cleanup(supervisor.Stop)
+
+	return watcher, supervisor
+}
+
+func TestIdpSupervisor_ActivatesRecoveredIdp(t *testing.T) {
+	primary := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	secondary := newMockOIDCProvider(t, newTestSigner(t, "k2"))
+	secondary.unavailable.Store(true)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "secondary", IssuerURL: secondary.issuer(), ClientID: "nats", IgnoreSetupError: true},
+			{Description: "primary", IssuerURL: primary.issuer(), ClientID: "nats"},
+		},
+	}
+
+	health := metrics.NewHealthChecker()
+	watcher, supervisor := newSupervisedWatcher(t, config, health)
+	supervisor.Start()
+
+	_, checks := health.IsReady()
+	assert.Equal(t, metrics.IDPStateActive, checks["idp:primary"])
+	assert.Contains(t, []string{metrics.IDPStatePending, metrics.IDPStateFailing}, checks["idp:secondary"])
+
+	token := secondary.mint(t, map[string]interface{}{"aud": "nats", "sub": "bob"})
+	_, _, _, err := runVerification(context.Background(), token, watcher.State().idpVerifiers)
+	require.Error(t, err, "secondary IDP should not verify tokens before it recovers")
+
+	assert.Eventually(t, func() bool {
+		_, checks := health.IsReady()
+		return checks["idp:secondary"] == metrics.IDPStateFailing
+	}, 2*time.Second, 10*time.Millisecond, "failed retries should be reported")
+
+	secondary.unavailable.Store(false)
+
+	assert.Eventually(t, func() bool {
+		return len(watcher.State().idpVerifiers) == 2
+	}, 2*time.Second, 10*time.Millisecond, "recovered IDP should be activated")
+
+	state := watcher.State()
+	assert.Empty(t, state.pendingIdps)
+	assert.Equal(t, "secondary", state.idpVerifiers[0].config.Description, "verifiers should stay in config order")
+
+	_, checks = health.IsReady()
+	assert.Equal(t, metrics.IDPStateActive, checks["idp:secondary"])
+
+	claims, matched, _, err := runVerification(context.Background(), token, state.idpVerifiers)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", claims.Subject)
+	assert.Equal(t, "secondary", matched.config.Description)
+}
+
+func TestIdpSupervisor_DiscardsVerifierForSupersededConfig(t *testing.T) {
+	down := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	down.unavailable.Store(true)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "down", IssuerURL: down.issuer(), ClientID: "nats", IgnoreSetupError: true},
+		},
+	}
+
+	watcher, _ := newSupervisedWatcher(t, config, nil)
+	pending := watcher.State().pendingIdps
+	require.Len(t, pending, 1)
+
+	// Simulate a reload replacing the configuration
+	watcher.state.Store(&LiveState{config: &Config{}})
+
+	verifier := NewStaticJwtVerifier(NewServerContext(nil), []string{"nats"}, down.issuer(), nil, 0, 0, nil)
+	activated := watcher.activateVerifier(config, IdpAndJwtVerifier{verifier, pending[0]})
+	assert.False(t, activated)
+	assert.Empty(t, watcher.State().idpVerifiers)
+}
+
+func TestIdpSupervisor_StopCancelsRetries(t *testing.T) {
+	down := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	down.unavailable.Store(true)
+
+	config := &Config{
+		Idp: []Idp{
+			{Description: "down", IssuerURL: down.issuer(), ClientID: "nats", IgnoreSetupError: true},
+		},
+	}
+
+	_, supervisor := newSupervisedWatcher(t, config, nil)
+	supervisor.Start()
+
+	done := make(chan struct{})
+	go func() {
+		supervisor.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
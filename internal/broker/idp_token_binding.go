@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// defaultProofOfPossessionClaim is where a bound token carries the NATS
+	// user public nkey of the connection it was issued for.
+	defaultProofOfPossessionClaim = "cnf.nkey"
+
+	// tokenBoundClaim is set on the request claims to record whether the token
+	// was bound to the connecting nkey. Role bindings with require_bound_token
+	// only match when it is true.
+	tokenBoundClaim = "nkey_bound"
+)
+
+var (
+	errTokenNotBound     = errors.New("token is not bound to a nats user nkey")
+	errTokenBindingWrong = errors.New("token is bound to a different nats user nkey")
+	errNkeyNotProven     = errors.New("client did not prove possession of the nats user nkey its token is bound to")
+)
+
+// checkTokenBinding reports whether claims bind the token to the nkey the
+// client connected with. The nkey in the connect options is the client's own;
+// the request's UserNkey is generated by the server for each auth callout and
+// cannot be known in advance. A token that names a different nkey is always
+// rejected, so a stolen bound token cannot be replayed from another
+// connection, and a bound token is only accepted when the client signed the
+// server's nonce with the nkey. An unbound token is only rejected when the IDP
+// requires binding.
+func checkTokenBinding(claims map[string]interface{}, cfg ProofOfPossessionConfig, request *jwt.AuthorizationRequestClaims) (bool, error) {
+	path := cfg.Claim
+	if path == "" {
+		path = defaultProofOfPossessionClaim
+	}
+
+	value, ok := claimAtPath(claims, path)
+	if !ok {
+		if cfg.Required {
+			return false, errTokenNotBound
+		}
+		return false, nil
+	}
+
+	clientNkey := request.ConnectOptions.Nkey
+	if nkey, _ := value.(string); nkey == "" || nkey != clientNkey {
+		return false, errTokenBindingWrong
+	}
+	if !verifyNonceSignature(clientNkey, request.ClientInformation.Nonce, request.ConnectOptions.SignedNonce) {
+		return false, errNkeyNotProven
+	}
+	return true, nil
+}
+
+// verifyNonceSignature checks that signedNonce is nonce signed by the private
+// half of the public nkey, as NATS clients sign it when connecting with an
+// nkey.
+func verifyNonceSignature(nkey string, nonce string, signedNonce string) bool {
+	if nonce == "" || signedNonce == "" {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signedNonce)
+	if err != nil {
+		// Older clients use standard base64
+		if sig, err = base64.StdEncoding.DecodeString(signedNonce); err != nil {
+			return false
+		}
+	}
+	pub, err := nkeys.FromPublicKey(nkey)
+	if err != nil {
+		return false
+	}
+	return pub.Verify([]byte(nonce), sig) == nil
+}
+
+// accepts reports whether the binding may be applied to a request with the
+// given claims context.
+func (rb *RoleBinding) accepts(context map[string]interface{}) bool {
+	if !rb.RequireBoundToken {
+		return true
+	}
+	bound, _ := context[tokenBoundClaim].(bool)
+	return bound
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckTokenBinding(t *testing.T) {
+	clientKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	clientNkey, err := clientKey.PublicKey()
+	require.NoError(t, err)
+	otherKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+
+	const nonce = "server-nonce"
+	sign := func(kp nkeys.KeyPair) string {
+		sig, err := kp.Sign([]byte(nonce))
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	// newRequest builds an auth callout request for a client that connected
+	// with clientNkey. UserNkey is the key the server generated for the
+	// callout and never matches a bound token.
+	newRequest := func(sig string) *jwt.AuthorizationRequestClaims {
+		request := &jwt.AuthorizationRequestClaims{}
+		request.UserNkey = "USERVERGENERATED"
+		request.ConnectOptions.Nkey = clientNkey
+		request.ConnectOptions.SignedNonce = sig
+		request.ClientInformation.Nonce = nonce
+		return request
+	}
+
+	testCases := []struct {
+		name      string
+		claims    map[string]interface{}
+		cfg       ProofOfPossessionConfig
+		request   *jwt.AuthorizationRequestClaims
+		wantBound bool
+		wantErr   error
+	}{
+		{name: "unbound token", claims: map[string]interface{}{"sub": "alice"}, request: newRequest("")},
+		{name: "unbound token required", claims: map[string]interface{}{"sub": "alice"}, cfg: ProofOfPossessionConfig{Required: true}, request: newRequest(""), wantErr: errTokenNotBound},
+		{name: "bound to connecting nkey", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": clientNkey}}, request: newRequest(sign(clientKey)), wantBound: true},
+		{name: "bound to callout user nkey", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": "USERVERGENERATED"}}, request: newRequest(sign(clientKey)), wantErr: errTokenBindingWrong},
+		{name: "bound to another nkey", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": "UOTHER"}}, request: newRequest(sign(clientKey)), wantErr: errTokenBindingWrong},
+		{name: "binding claim not a string", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": 42.0}}, request: newRequest(sign(clientKey)), wantErr: errTokenBindingWrong},
+		{name: "nonce not signed", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": clientNkey}}, request: newRequest(""), wantErr: errNkeyNotProven},
+		{name: "nonce signed by another key", claims: map[string]interface{}{"cnf": map[string]interface{}{"nkey": clientNkey}}, request: newRequest(sign(otherKey)), wantErr: errNkeyNotProven},
+		{name: "custom claim", claims: map[string]interface{}{"nats_nkey": clientNkey}, cfg: ProofOfPossessionConfig{Claim: "nats_nkey", Required: true}, request: newRequest(sign(clientKey)), wantBound: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bound, err := checkTokenBinding(tc.claims, tc.cfg, tc.request)
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantBound, bound)
+		})
+	}
+}
+
+func TestLookupUserAccount_RequireBoundToken(t *testing.T) {
+	config := &Config{Rbac: Rbac{
+		Roles: []Role{{Name: "admin"}, {Name: "reader"}},
+		RoleBinding: []RoleBinding{
+			{Account: "Admins", Roles: []string{"admin"}, Match: []Match{{Claim: "sub", Value: "alice"}}, RequireBoundToken: true},
+			{Account: "Readers", Roles: []string{"reader"}},
+		},
+		RoleBindingMatchingStrategy: StrategyStrict,
+	}}
+
+	account, _, _, _, err := config.lookupUserAccount(map[string]interface{}{"sub": "alice", tokenBoundClaim: true})
+	require.NoError(t, err)
+	assert.Equal(t, "Admins", account)
+
+	account, _, _, _, err = config.lookupUserAccount(map[string]interface{}{"sub": "alice", tokenBoundClaim: false})
+	require.NoError(t, err)
+	assert.Equal(t, "Readers", account, "an unbound token should fall through to the next binding")
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"golang.org/x/oauth2"
+)
+
+var errRefreshTokenRejected = errors.New("refresh token rejected by idp")
+
+// tokenRefresher redeems refresh tokens for fresh ID tokens at an IDP's token
+// endpoint. The tokens it obtains are not returned to the client, so the IDP
+// must issue non-rotating refresh tokens: a rotated one is lost, and the
+// client's next refresh reuses a spent token.
+type tokenRefresher struct {
+	oauth oauth2.Config
+}
+
+func newTokenRefresher(clientID string, clientSecret string, tokenURL string) *tokenRefresher {
+	return &tokenRefresher{
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+		},
+	}
+}
+
+// refresh returns tokens obtained with refreshToken.
+func (r *tokenRefresher) refresh(ctx context.Context, refreshToken string) (TokenRequest, error) {
+	refreshCtx, refreshCancel := context.WithTimeout(ctx, oidcTimeout)
+	defer refreshCancel()
+
+	// An expired token with only a refresh token makes the token source
+	// redeem it immediately.
+	token, err := r.oauth.TokenSource(refreshCtx, &oauth2.Token{RefreshToken: refreshToken, Expiry: time.Unix(1, 0)}).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return TokenRequest{}, errRefreshTokenRejected
+		}
+		return TokenRequest{}, fmt.Errorf("token refresh failed: %w", err)
+	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return TokenRequest{}, errors.New("refresh response has no id_token")
+	}
+
+	return TokenRequest{
+		AccessToken:  token.AccessToken,
+		IDToken:      idToken,
+		RefreshToken: token.RefreshToken,
+		TokenType:    token.TokenType,
+	}, nil
+}
+
+// isRotated reports whether the IDP replaced the refresh token it redeemed.
+func isRotated(sent string, refreshed TokenRequest) bool {
+	return refreshed.RefreshToken != "" && refreshed.RefreshToken != sent
+}
+
+// checkRefreshedIdentity rejects a refreshed ID token whose issuer or subject
+// differs from the expired token it replaces.
+func checkRefreshedIdentity(expiredToken string, refreshedToken string) error {
+	expired, err := parseUnverifiedRouting(expiredToken)
+	if err != nil {
+		return err
+	}
+	refreshed, err := parseUnverifiedRouting(refreshedToken)
+	if err != nil {
+		return err
+	}
+	if refreshed.Issuer != expired.Issuer || refreshed.Subject != expired.Subject {
+		return fmt.Errorf("refreshed token is for %q at %q, expired token for %q at %q",
+			refreshed.Subject, refreshed.Issuer, expired.Subject, expired.Issuer)
+	}
+	return nil
+}
+
+// tokenRefreshResult classifies a token refresh error for metrics and audit.
+func tokenRefreshResult(err error) string {
+	switch {
+	case err == nil:
+		return metrics.StatusSuccess
+	case errors.Is(err, errRefreshTokenRejected):
+		return metrics.ResultInvalidGrant
+	default:
+		return metrics.StatusError
+	}
+}
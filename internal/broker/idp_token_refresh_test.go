@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"github.com/nats-io/jwt/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handleRefresh registers a token endpoint on the mock provider that issues a
+// fresh ID token with claims, and a rotated refresh token, when given the
+// expected refresh token.
+func (m *mockOIDCProvider) handleRefresh(t *testing.T, refreshToken string, claims map[string]interface{}) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	m.mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("grant_type") != "refresh_token" || r.PostFormValue("refresh_token") != refreshToken {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": refreshToken + "-rotated",
+			"token_type":    "Bearer",
+			"expires_in":    300,
+			"id_token":      m.mint(t, claims),
+		})
+	})
+	return &calls
+}
+
+func TestVerifyWithRefresh(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	calls := provider.handleRefresh(t, "rt-1", map[string]interface{}{"aud": "nats", "sub": "alice", "email": "alice@example.com"})
+
+	config := &Config{
+		Service: Service{Name: "iam"},
+		Idp: []Idp{{
+			Description: "sso", IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s3cret",
+			Refresh: RefreshConfig{Enabled: true},
+		}},
+	}
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+
+	expired := provider.mint(t, map[string]interface{}{
+		"aud": "nats", "sub": "alice",
+		"iat": time.Now().Add(-2 * time.Hour).Unix(),
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	request := &jwt.AuthorizationRequestClaims{}
+	request.UserNkey = "UNKEY"
+
+	t.Run("valid token is not refreshed", func(t *testing.T) {
+		valid := provider.mint(t, map[string]interface{}{"aud": "nats", "sub": "alice"})
+		_, _, refreshed, err := verifyWithRefresh(context.Background(), nil, nil, config, valid, TokenRequest{RefreshToken: "rt-1"}, verifiers, request)
+		require.NoError(t, err)
+		assert.False(t, refreshed)
+		assert.Zero(t, calls.Load())
+	})
+
+	t.Run("expired token without refresh token", func(t *testing.T) {
+		_, _, _, err := verifyWithRefresh(context.Background(), nil, nil, config, expired, TokenRequest{}, verifiers, request)
+		var expiredErr *oidc.TokenExpiredError
+		assert.ErrorAs(t, err, &expiredErr)
+		assert.Zero(t, calls.Load())
+	})
+
+	t.Run("expired token is refreshed", func(t *testing.T) {
+		claims, matched, refreshed, err := verifyWithRefresh(context.Background(), nil, nil, config, expired, TokenRequest{RefreshToken: "rt-1"}, verifiers, request)
+		require.NoError(t, err)
+		assert.True(t, refreshed)
+		assert.Equal(t, "alice@example.com", claims.Email)
+		assert.Equal(t, "sso", matched.config.Description)
+		assert.Equal(t, int32(1), calls.Load())
+
+		_, _, refreshed, err = verifyWithRefresh(context.Background(), nil, nil, config, expired, TokenRequest{RefreshToken: "rt-1"}, verifiers, request)
+		require.NoError(t, err)
+		assert.True(t, refreshed)
+		assert.Equal(t, int32(2), calls.Load(), "every refresh should reach the idp so it can detect reuse")
+	})
+
+	t.Run("refreshed token for another subject", func(t *testing.T) {
+		expiredBob := provider.mint(t, map[string]interface{}{
+			"aud": "nats", "sub": "bob",
+			"iat": time.Now().Add(-2 * time.Hour).Unix(),
+			"exp": time.Now().Add(-time.Hour).Unix(),
+		})
+		_, _, refreshed, err := verifyWithRefresh(context.Background(), nil, nil, config, expiredBob, TokenRequest{RefreshToken: "rt-1"}, verifiers, request)
+		var expiredErr *oidc.TokenExpiredError
+		assert.ErrorAs(t, err, &expiredErr)
+		assert.False(t, refreshed)
+	})
+
+	t.Run("rejected refresh token", func(t *testing.T) {
+		_, _, _, err := verifyWithRefresh(context.Background(), nil, nil, config, expired, TokenRequest{RefreshToken: "revoked"}, verifiers, request)
+		var expiredErr *oidc.TokenExpiredError
+		assert.ErrorAs(t, err, &expiredErr, "the original expiry should be reported")
+
+		_, err = verifiers[0].verifier.refresher.refresh(context.Background(), "revoked")
+		assert.ErrorIs(t, err, errRefreshTokenRejected)
+		assert.Equal(t, metrics.ResultInvalidGrant, tokenRefreshResult(err))
+	})
+}
+
+func TestVerifyWithRefresh_Disabled(t *testing.T) {
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	calls := provider.handleRefresh(t, "rt-1", map[string]interface{}{"aud": "nats", "sub": "alice"})
+
+	config := &Config{Idp: []Idp{{Description: "sso", IssuerURL: provider.issuer(), ClientID: "nats"}}}
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+
+	expired := provider.mint(t, map[string]interface{}{
+		"aud": "nats", "sub": "alice",
+		"iat": time.Now().Add(-2 * time.Hour).Unix(),
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	_, _, _, err = verifyWithRefresh(context.Background(), nil, nil, config, expired, TokenRequest{RefreshToken: "rt-1"}, verifiers, &jwt.AuthorizationRequestClaims{})
+	assert.Error(t, err)
+	assert.Zero(t, calls.Load(), "idps without refresh enabled should not redeem refresh tokens")
+}
+
+func TestVerifyWithRefresh_RotatedIsAudited(t *testing.T) {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	require.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	provider := newMockOIDCProvider(t, newTestSigner(t, "k1"))
+	provider.handleRefresh(t, "rt-1", map[string]interface{}{"aud": "nats", "sub": "alice"})
+
+	config := &Config{
+		Service: Service{Name: "iam"},
+		Idp: []Idp{{
+			Description: "sso", IssuerURL: provider.issuer(), ClientID: "nats", ClientSecret: "s3cret",
+			Refresh: RefreshConfig{Enabled: true},
+		}},
+	}
+	verifiers, err := NewIdpVerifiers(NewServerContext(nil), config)
+	require.NoError(t, err)
+
+	sub, err := nc.SubscribeSync(tokenRefreshRotatedSubject(config))
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	expired := provider.mint(t, map[string]interface{}{
+		"aud": "nats", "sub": "alice",
+		"iat": time.Now().Add(-2 * time.Hour).Unix(),
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	request := &jwt.AuthorizationRequestClaims{}
+	request.UserNkey = "UNKEY"
+
+	_, _, refreshed, err := verifyWithRefresh(context.Background(), nil, nc, config, expired, TokenRequest{RefreshToken: "rt-1"}, verifiers, request)
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	require.NoError(t, nc.Flush())
+
+	msg, err := sub.NextMsg(2 * time.Second)
+	require.NoError(t, err, "a rotated refresh token should be audited")
+	assert.NotContains(t, string(msg.Data), "rt-1")
+
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "sso", event["idp"])
+	assert.Equal(t, metrics.ResultRotated, event["result"])
+
+	assert.False(t, isRotated("rt-1", TokenRequest{RefreshToken: "rt-1"}))
+	assert.False(t, isRotated("rt-1", TokenRequest{}))
+}
+
+func TestCheckRefreshedIdentity(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	expired := signer.mint(t, map[string]interface{}{"iss": "https://idp.example.com", "sub": "alice"})
+
+	assert.NoError(t, checkRefreshedIdentity(expired, signer.mint(t, map[string]interface{}{"iss": "https://idp.example.com", "sub": "alice"})))
+	assert.Error(t, checkRefreshedIdentity(expired, signer.mint(t, map[string]interface{}{"iss": "https://idp.example.com", "sub": "bob"})))
+	assert.Error(t, checkRefreshedIdentity(expired, signer.mint(t, map[string]interface{}{"iss": "https://other.example.com", "sub": "alice"})))
+	assert.Error(t, checkRefreshedIdentity("not-a-jwt", expired))
+}
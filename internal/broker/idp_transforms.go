@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// claimTransform is a compiled transforms entry. apply maps one string value
+// to the values that replace it, so that split can produce several and a
+// regex extraction none.
+type claimTransform struct {
+	claim  string
+	target string
+	split  bool // the result is always a list, even for a string claim
+	apply  func(string) []string
+}
+
+// compileClaimTransforms validates an IDP's transforms and compiles their
+// regular expressions. Each entry must set exactly one operation.
+func compileClaimTransforms(cfgs []ClaimTransform) ([]claimTransform, error) {
+	transforms := make([]claimTransform, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		if cfg.Claim == "" {
+			return nil, fmt.Errorf("transforms[%d] has no claim", i)
+		}
+		transform := claimTransform{claim: cfg.Claim, target: cfg.Target}
+		if transform.target == "" {
+			transform.target = cfg.Claim
+		}
+		if slices.Contains(brokerClaims, transform.target) {
+			return nil, fmt.Errorf("transforms[%d] cannot write %q, it is set by the broker", i, transform.target)
+		}
+		if cfg.Replace != nil && cfg.Regex == "" {
+			return nil, fmt.Errorf("transforms[%d] sets replace without regex", i)
+		}
+
+		var ops []string
+		if cfg.Lowercase {
+			ops = append(ops, "lowercase")
+			transform.apply = func(s string) []string { return []string{strings.ToLower(s)} }
+		}
+		if cfg.Split != "" {
+			ops = append(ops, "split")
+			transform.split = true
+			transform.apply = splitValue(cfg.Split)
+		}
+		if cfg.Regex != "" {
+			ops = append(ops, "regex")
+			re, err := regexp.Compile(cfg.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("transforms[%d] has an invalid regex %q: %w", i, cfg.Regex, err)
+			}
+			if cfg.Replace != nil {
+				replacement := *cfg.Replace
+				transform.apply = func(s string) []string { return []string{re.ReplaceAllString(s, replacement)} }
+			} else {
+				transform.apply = extractValue(re)
+			}
+		}
+		if cfg.Prefix != "" {
+			ops = append(ops, "prefix")
+			transform.apply = func(s string) []string { return []string{cfg.Prefix + s} }
+		}
+		if cfg.StripPrefix != "" {
+			ops = append(ops, "strip_prefix")
+			transform.apply = func(s string) []string { return []string{strings.TrimPrefix(s, cfg.StripPrefix)} }
+		}
+		if len(cfg.Map) > 0 {
+			ops = append(ops, "map")
+			transform.apply = func(s string) []string {
+				if mapped, ok := cfg.Map[s]; ok {
+					return []string{mapped}
+				}
+				return []string{s}
+			}
+		}
+
+		switch len(ops) {
+		case 0:
+			return nil, fmt.Errorf("transforms[%d] has no operation; set one of lowercase, split, regex, prefix, strip_prefix or map", i)
+		case 1:
+		default:
+			return nil, fmt.Errorf("transforms[%d] sets several operations (%s); use one entry per operation", i, strings.Join(ops, ", "))
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// splitValue splits a value on sep, trimming spaces and dropping empty parts.
+func splitValue(sep string) func(string) []string {
+	return func(s string) []string {
+		var parts []string
+		for _, part := range strings.Split(s, sep) {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return parts
+	}
+}
+
+// extractValue keeps the first capture group of re, or the whole match when
+// re has no groups. Values that do not match are dropped.
+func extractValue(re *regexp.Regexp) func(string) []string {
+	return func(s string) []string {
+		match := re.FindStringSubmatch(s)
+		if match == nil {
+			return nil
+		}
+		if len(match) > 1 {
+			return []string{match[1]}
+		}
+		return []string{match[0]}
+	}
+}
+
+// applyClaimTransforms runs transforms over claims in order, so that each
+// sees the result of the previous ones. A transform applies to a string claim
+// or to each string in a list claim; other values are left as they are, and
+// transforms of claims missing from the token are skipped.
+func applyClaimTransforms(transforms []claimTransform, claims map[string]interface{}) {
+	for _, transform := range transforms {
+		value, ok := claimAtPath(claims, transform.claim)
+		if !ok {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			results := transform.apply(v)
+			switch {
+			case transform.split:
+				claims[transform.target] = toInterfaceList(results)
+			case len(results) == 0:
+				delete(claims, transform.target)
+			default:
+				claims[transform.target] = results[0]
+			}
+		case []interface{}, []string:
+			values := claimValues(v)
+			out := make([]interface{}, 0, len(values))
+			for _, item := range values {
+				s, isString := item.(string)
+				if !isString {
+					out = append(out, item)
+					continue
+				}
+				out = append(out, toInterfaceList(transform.apply(s))...)
+			}
+			claims[transform.target] = out
+		}
+	}
+}
+
+func toInterfaceList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
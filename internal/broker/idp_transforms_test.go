@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyClaimTransforms(t *testing.T) {
+	empty := ""
+	dollar := "team-$1"
+
+	tests := []struct {
+		name       string
+		transforms []ClaimTransform
+		claims     map[string]interface{}
+		expected   map[string]interface{}
+	}{
+		{
+			name:       "lowercase string",
+			transforms: []ClaimTransform{{Claim: "email", Lowercase: true}},
+			claims:     map[string]interface{}{"email": "Alice@Example.COM"},
+			expected:   map[string]interface{}{"email": "alice@example.com"},
+		},
+		{
+			name:       "split comma-separated string",
+			transforms: []ClaimTransform{{Claim: "groups", Split: ","}},
+			claims:     map[string]interface{}{"groups": "admins, devs,,ops "},
+			expected:   map[string]interface{}{"groups": []interface{}{"admins", "devs", "ops"}},
+		},
+		{
+			name:       "extract common name from DN groups",
+			transforms: []ClaimTransform{{Claim: "groups", Regex: "^CN=([^,]+)"}},
+			claims:     map[string]interface{}{"groups": []interface{}{"CN=nats-admins,OU=Groups,DC=corp", "not-a-dn", 42.0}},
+			expected:   map[string]interface{}{"groups": []interface{}{"nats-admins", 42.0}},
+		},
+		{
+			name:       "extract drops non-matching string claim",
+			transforms: []ClaimTransform{{Claim: "department", Regex: "^dept-(.+)$"}},
+			claims:     map[string]interface{}{"department": "unknown"},
+			expected:   map[string]interface{}{},
+		},
+		{
+			name:       "regex replace",
+			transforms: []ClaimTransform{{Claim: "groups", Regex: "^grp_(.*)$", Replace: &dollar}},
+			claims:     map[string]interface{}{"groups": []string{"grp_a", "other"}},
+			expected:   map[string]interface{}{"groups": []interface{}{"team-a", "other"}},
+		},
+		{
+			name:       "regex replace with empty string",
+			transforms: []ClaimTransform{{Claim: "upn", Regex: "@.*$", Replace: &empty}},
+			claims:     map[string]interface{}{"upn": "alice@corp.example.com"},
+			expected:   map[string]interface{}{"upn": "alice"},
+		},
+		{
+			name:       "prefix and strip prefix",
+			transforms: []ClaimTransform{{Claim: "roles", StripPrefix: "app-"}, {Claim: "roles", Prefix: "idp:"}},
+			claims:     map[string]interface{}{"roles": []interface{}{"app-reader", "writer"}},
+			expected:   map[string]interface{}{"roles": []interface{}{"idp:reader", "idp:writer"}},
+		},
+		{
+			name:       "map values",
+			transforms: []ClaimTransform{{Claim: "groups", Map: map[string]string{"Domain Admins": "admins"}}},
+			claims:     map[string]interface{}{"groups": []interface{}{"Domain Admins", "Users"}},
+			expected:   map[string]interface{}{"groups": []interface{}{"admins", "Users"}},
+		},
+		{
+			name: "nested source written to target",
+			transforms: []ClaimTransform{
+				{Claim: "realm_access.roles", Target: "roles", Lowercase: true},
+			},
+			claims: map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"Admin"}}},
+			expected: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"Admin"}},
+				"roles":        []interface{}{"admin"},
+			},
+		},
+		{
+			name:       "transforms run in order",
+			transforms: []ClaimTransform{{Claim: "groups", Split: ";"}, {Claim: "groups", Lowercase: true}},
+			claims:     map[string]interface{}{"groups": "Admins;Devs"},
+			expected:   map[string]interface{}{"groups": []interface{}{"admins", "devs"}},
+		},
+		{
+			name:       "missing claim is skipped",
+			transforms: []ClaimTransform{{Claim: "groups", Split: ","}},
+			claims:     map[string]interface{}{"sub": "alice"},
+			expected:   map[string]interface{}{"sub": "alice"},
+		},
+		{
+			name:       "non-string claim is left as is",
+			transforms: []ClaimTransform{{Claim: "email_verified", Lowercase: true}},
+			claims:     map[string]interface{}{"email_verified": true},
+			expected:   map[string]interface{}{"email_verified": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transforms, err := compileClaimTransforms(tt.transforms)
+			require.NoError(t, err)
+			applyClaimTransforms(transforms, tt.claims)
+			assert.Equal(t, tt.expected, tt.claims)
+		})
+	}
+}
+
+func TestCompileClaimTransforms_Errors(t *testing.T) {
+	replace := "x"
+
+	tests := []struct {
+		name      string
+		transform ClaimTransform
+		errMsg    string
+	}{
+		{name: "no claim", transform: ClaimTransform{Lowercase: true}, errMsg: "has no claim"},
+		{name: "no operation", transform: ClaimTransform{Claim: "email"}, errMsg: "has no operation"},
+		{name: "several operations", transform: ClaimTransform{Claim: "email", Lowercase: true, Prefix: "x"}, errMsg: "several operations (lowercase, prefix)"},
+		{name: "invalid regex", transform: ClaimTransform{Claim: "groups", Regex: "("}, errMsg: "invalid regex"},
+		{name: "replace without regex", transform: ClaimTransform{Claim: "groups", Replace: &replace}, errMsg: "replace without regex"},
+		{name: "broker claim target", transform: ClaimTransform{Claim: "sub", Target: "client_id", Lowercase: true}, errMsg: "set by the broker"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileClaimTransforms([]ClaimTransform{tt.transform})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/jr200-labs/nats-iam-broker/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	UserInfoCacheKeyAccessToken = "access_token"
+	UserInfoCacheKeySubject     = "sub"
+)
+
+type userInfoCacheEntry struct {
+	claims     map[string]interface{}
+	freshUntil time.Time
+}
+
+// userInfoCache remembers an IDP's UserInfo responses. Entries are fresh for
+// ttl; for staleTTL after that they are still returned, while the response is
+// fetched again in the background, so that reconnects stay fast and survive
+// brief IDP outages.
+type userInfoCache struct {
+	idp      string // IDP description, used as the metrics label
+	bySub    bool   // key entries by subject rather than access token
+	ttl      time.Duration
+	staleTTL time.Duration
+	entries  *ttlCache[userInfoCacheEntry]
+	metrics  *metrics.Metrics
+	now      func() time.Time
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+}
+
+func newUserInfoCache(idp string, cfg UserInfoConfig, m *metrics.Metrics) *userInfoCache {
+	return &userInfoCache{
+		idp:        idp,
+		bySub:      cfg.CacheKey == UserInfoCacheKeySubject,
+		ttl:        cfg.CacheTTL.Duration,
+		staleTTL:   cfg.StaleTTL.Duration,
+		entries:    newTTLCache[userInfoCacheEntry](cfg.MaxEntries),
+		metrics:    m,
+		now:        time.Now,
+		refreshing: make(map[string]bool),
+	}
+}
+
+// key returns the cache key for a token: a hash of the access token, or the
+// subject when configured to share responses across a user's tokens.
+func (c *userInfoCache) key(accessToken string, subject string) string {
+	if c.bySub {
+		return UserInfoCacheKeySubject + ":" + subject
+	}
+	sum := sha256.Sum256([]byte(accessToken))
+	return UserInfoCacheKeyAccessToken + ":" + hex.EncodeToString(sum[:])
+}
+
+// get returns the cached claims for key, calling fetch on a miss. A stale
+// entry is returned as is and refreshed with fetch in the background.
+func (c *userInfoCache) get(ctx context.Context, key string, fetch func(context.Context) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	if entry, ok := c.entries.get(key); ok {
+		if c.now().Before(entry.freshUntil) {
+			c.record(metrics.ResultHit)
+			return entry.claims, nil
+		}
+		c.record(metrics.ResultStale)
+		c.revalidate(key, fetch)
+		return entry.claims, nil
+	}
+
+	c.record(metrics.ResultMiss)
+	claims, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, claims)
+	return claims, nil
+}
+
+// revalidate fetches key again in the background, unless a fetch for it is
+// already running. On failure the stale entry is kept.
+func (c *userInfoCache) revalidate(key string, fetch func(context.Context) (map[string]interface{}, error)) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+
+		fetchCtx, fetchCancel := context.WithTimeout(context.Background(), oidcTimeout)
+		defer fetchCancel()
+
+		claims, err := fetch(fetchCtx)
+		if err != nil {
+			zap.L().Warn("failed to revalidate cached user info", zap.String("idp", c.idp), zap.Error(err))
+			return
+		}
+		c.store(key, claims)
+	}()
+}
+
+func (c *userInfoCache) store(key string, claims map[string]interface{}) {
+	freshUntil := c.now().Add(c.ttl)
+	c.entries.set(key, userInfoCacheEntry{claims: claims, freshUntil: freshUntil}, freshUntil.Add(c.staleTTL))
+}
+
+func (c *userInfoCache) record(result string) {
+	if c.metrics != nil {
+		c.metrics.UserInfoCacheRequests.WithLabelValues(c.idp, result).Inc()
+	}
+}
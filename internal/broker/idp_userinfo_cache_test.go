@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserInfoCache(t *testing.T) {
+	cache := newUserInfoCache("sso", UserInfoConfig{CacheTTL: Duration{time.Minute}, StaleTTL: Duration{time.Hour}}, nil)
+	now := time.Now()
+	var clock atomic.Pointer[time.Time]
+	clock.Store(&now)
+	cache.now = func() time.Time { return *clock.Load() }
+	cache.entries.now = cache.now
+	advance := func(d time.Duration) {
+		next := clock.Load().Add(d)
+		clock.Store(&next)
+	}
+
+	var calls atomic.Int32
+	var failing atomic.Bool
+	fetch := func(context.Context) (map[string]interface{}, error) {
+		n := calls.Add(1)
+		if failing.Load() {
+			return nil, errors.New("idp unavailable")
+		}
+		return map[string]interface{}{"department": "ops", "version": n}, nil
+	}
+	key := cache.key("access-token", "alice")
+
+	claims, err := cache.get(context.Background(), key, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), claims["version"])
+
+	claims, err = cache.get(context.Background(), key, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), claims["version"])
+	assert.Equal(t, int32(1), calls.Load(), "fresh entries should be served from the cache")
+
+	// Stale entries are served while the idp is unavailable.
+	failing.Store(true)
+	advance(2 * time.Minute)
+	claims, err = cache.get(context.Background(), key, fetch)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), claims["version"])
+	require.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return calls.Load() == 2 && !cache.refreshing[key]
+	}, 5*time.Second, 10*time.Millisecond, "stale entries should be revalidated in the background")
+
+	failing.Store(false)
+	require.Eventually(t, func() bool {
+		claims, err = cache.get(context.Background(), key, fetch)
+		return err == nil && claims["version"] == int32(3)
+	}, 5*time.Second, 10*time.Millisecond, "a successful revalidation should replace the stale entry")
+
+	// Past the stale window the idp must be reached again.
+	failing.Store(true)
+	advance(2 * time.Hour)
+	_, err = cache.get(context.Background(), key, fetch)
+	assert.ErrorContains(t, err, "idp unavailable")
+}
+
+func TestUserInfoCache_Key(t *testing.T) {
+	byToken := newUserInfoCache("sso", UserInfoConfig{CacheTTL: Duration{time.Minute}}, nil)
+	assert.NotEqual(t, byToken.key("token-a", "alice"), byToken.key("token-b", "alice"))
+	assert.NotContains(t, byToken.key("token-a", "alice"), "token-a", "access tokens should not be stored in keys")
+
+	bySub := newUserInfoCache("sso", UserInfoConfig{CacheTTL: Duration{time.Minute}, CacheKey: UserInfoCacheKeySubject}, nil)
+	assert.Equal(t, bySub.key("token-a", "alice"), bySub.key("token-b", "alice"))
+	assert.NotEqual(t, bySub.key("token-a", "alice"), bySub.key("token-a", "bob"))
+}
@@ -1,5 +1,7 @@
 package broker
 
+import "github.com/jr200-labs/nats-iam-broker/internal/metrics"
+
 const DefaultMetricsPort = 8080
 
 // Options holds all configuration options for the server
@@ -26,6 +28,7 @@ type Options struct {
 // Context holds both server options and other server state
 type Context struct {
 	Options *Options
+	Metrics *metrics.Metrics // nil when metrics are disabled
 }
 
 // NewServerContext creates a new server.Context with the given options
@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	ReplayBackendMemory = "memory"
+	ReplayBackendNatsKV = "nats_kv"
+
+	defaultReplayBucket     = "iam_broker_replay"
+	defaultReplayMaxEntries = 100000
+	kvOperationTimeout      = 5 * time.Second
+
+	// defaultReplayTTL outlives tokens accepted with the default
+	// max_token_lifetime and clock_skew.
+	defaultReplayTTL = DefaultMaxTokenLifetime + DefaultClockSkew
+)
+
+var (
+	errTokenReplayed   = errors.New("token has already been used the maximum number of times")
+	errReplayStoreFull = errors.New("replay cache is full")
+)
+
+// replayStore counts how often each token has been redeemed.
+type replayStore interface {
+	// redeem records one use of key, remembered until expiresAt, and returns
+	// the number of uses including this one.
+	redeem(ctx context.Context, key string, expiresAt time.Time) (int, error)
+}
+
+// newReplayStore creates the store for the configured backend, or returns nil
+// if replay protection is disabled.
+func newReplayStore(ctx context.Context, cfg ReplayConfig, nc *nats.Conn) (replayStore, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	switch cfg.Backend {
+	case "", ReplayBackendMemory:
+		return newMemoryReplayStore(), nil
+	case ReplayBackendNatsKV:
+		return newKVReplayStore(ctx, cfg, nc)
+	default:
+		return nil, fmt.Errorf("unknown replay backend %q", cfg.Backend)
+	}
+}
+
+// replayKey identifies a token by its issuer and jti, or by a hash of the raw
+// token when it has no jti. Keys are hashed so they are valid KV keys.
+func replayKey(issuer string, jti string, rawToken string) string {
+	var sum [sha256.Size]byte
+	if jti != "" {
+		sum = sha256.Sum256([]byte(issuer + "\x00" + jti))
+	} else {
+		sum = sha256.Sum256([]byte(rawToken))
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// checkReplay redeems key and rejects the token once it has been used more
+// than maxUses times.
+func checkReplay(ctx context.Context, store replayStore, maxUses int, key string, expiresAt time.Time) error {
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	uses, err := store.redeem(ctx, key, expiresAt)
+	if err != nil {
+		return fmt.Errorf("replay check failed: %w", err)
+	}
+	if uses > maxUses {
+		return errTokenReplayed
+	}
+	return nil
+}
+
+// memoryReplayStore keeps use counts in process memory, for single instances.
+type memoryReplayStore struct {
+	mu   sync.Mutex // makes the read-increment-write of a count atomic
+	uses *ttlCache[int]
+}
+
+func newMemoryReplayStore() *memoryReplayStore {
+	return &memoryReplayStore{uses: newTTLCache[int](defaultReplayMaxEntries)}
+}
+
+func (s *memoryReplayStore) redeem(_ context.Context, key string, expiresAt time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uses, _ := s.uses.get(key)
+	uses++
+	// Evicting a live count would let its token be used again, so a full
+	// store fails the request instead.
+	if !s.uses.trySet(key, uses, expiresAt) {
+		return 0, errReplayStoreFull
+	}
+	return uses, nil
+}
+
+// kvTTL returns the lifetime of use counts in the nats_kv bucket.
+func (c ReplayConfig) kvTTL() time.Duration {
+	if c.TTL.Duration > 0 {
+		return c.TTL.Duration
+	}
+	return defaultReplayTTL
+}
+
+// kvReplayStore keeps use counts in a JetStream KV bucket, so broker replicas
+// in the same queue group share them. Entries expire with the bucket TTL.
+type kvReplayStore struct {
+	kv jetstream.KeyValue
+}
+
+func newKVReplayStore(ctx context.Context, cfg ReplayConfig, nc *nats.Conn) (*kvReplayStore, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jetstream context: %w", err)
+	}
+
+	bucket := cfg.Bucket
+	if bucket == "" {
+		bucket = defaultReplayBucket
+	}
+	ttl := cfg.kvTTL()
+
+	setupCtx, setupCancel := context.WithTimeout(ctx, kvOperationTimeout)
+	defer setupCancel()
+
+	kv, err := js.CreateOrUpdateKeyValue(setupCtx, jetstream.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "nats-iam-broker token replay cache",
+		TTL:         ttl,
+		History:     1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating replay kv bucket %s: %w", bucket, err)
+	}
+	return &kvReplayStore{kv: kv}, nil
+}
+
+// redeem increments the count with compare-and-set, retrying until the
+// timeout when another replica updated the same key concurrently. expiresAt
+// is not used; config validation ensures the bucket TTL outlives the tokens.
+func (s *kvReplayStore) redeem(ctx context.Context, key string, _ time.Time) (int, error) {
+	opCtx, opCancel := context.WithTimeout(ctx, kvOperationTimeout)
+	defer opCancel()
+
+	for opCtx.Err() == nil {
+		entry, err := s.kv.Get(opCtx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			_, err = s.kv.Create(opCtx, key, []byte("1"))
+			if errors.Is(err, jetstream.ErrKeyExists) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		uses, err := strconv.Atoi(string(entry.Value()))
+		if err != nil {
+			return 0, fmt.Errorf("invalid replay count for key %s: %w", key, err)
+		}
+		uses++
+		_, err = s.kv.Update(opCtx, key, []byte(strconv.Itoa(uses)), entry.Revision())
+		if isKVRevisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return uses, nil
+	}
+	return 0, fmt.Errorf("replay count for token changed concurrently: %w", opCtx.Err())
+}
+
+// isKVRevisionConflict reports whether a KV update failed because the key was
+// changed since it was read.
+func isKVRevisionConflict(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.Is(err, jetstream.ErrKeyExists) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence)
+}
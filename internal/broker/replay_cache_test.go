@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayKey(t *testing.T) {
+	assert.Equal(t, replayKey("https://idp", "jti-1", "token-a"), replayKey("https://idp", "jti-1", "token-b"), "tokens with the same jti share a key")
+	assert.NotEqual(t, replayKey("https://idp", "jti-1", "t"), replayKey("https://other", "jti-1", "t"), "jti is scoped to the issuer")
+	assert.NotEqual(t, replayKey("https://idp", "", "token-a"), replayKey("https://idp", "", "token-b"), "tokens without jti are keyed by hash")
+	assert.Regexp(t, `^[0-9a-f]{64}$`, replayKey("https://idp", "jti with spaces/and*wildcards", ""))
+}
+
+func TestCheckReplay_Memory(t *testing.T) {
+	store, err := newReplayStore(context.Background(), ReplayConfig{Enabled: true}, nil)
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(time.Hour)
+
+	t.Run("single use", func(t *testing.T) {
+		assert.NoError(t, checkReplay(context.Background(), store, 0, "once", expiresAt))
+		assert.ErrorIs(t, checkReplay(context.Background(), store, 0, "once", expiresAt), errTokenReplayed)
+	})
+
+	t.Run("n uses", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, checkReplay(context.Background(), store, 3, "thrice", expiresAt))
+		}
+		assert.ErrorIs(t, checkReplay(context.Background(), store, 3, "thrice", expiresAt), errTokenReplayed)
+	})
+
+	t.Run("full store fails closed", func(t *testing.T) {
+		store := &memoryReplayStore{uses: newTTLCache[int](2)}
+		require.NoError(t, checkReplay(context.Background(), store, 1, "a", expiresAt))
+		require.NoError(t, checkReplay(context.Background(), store, 1, "b", expiresAt))
+
+		err := checkReplay(context.Background(), store, 1, "c", expiresAt)
+		assert.ErrorIs(t, err, errReplayStoreFull)
+		assert.ErrorIs(t, checkReplay(context.Background(), store, 1, "a", expiresAt), errTokenReplayed, "live counts must not be evicted")
+		assert.ErrorIs(t, checkReplay(context.Background(), store, 1, "b", expiresAt), errTokenReplayed, "live counts must not be evicted")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		store, err := newReplayStore(context.Background(), ReplayConfig{}, nil)
+		require.NoError(t, err)
+		assert.Nil(t, store)
+	})
+}
+
+func TestReplayStore_NatsKV(t *testing.T) {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	require.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	defer ns.Shutdown()
+
+	cfg := ReplayConfig{Enabled: true, Backend: ReplayBackendNatsKV, Bucket: "replay_test"}
+	replicas := make([]replayStore, 2)
+	for i := range replicas {
+		nc, err := nats.Connect(ns.ClientURL())
+		require.NoError(t, err)
+		defer nc.Close()
+		replicas[i], err = newReplayStore(context.Background(), cfg, nc)
+		require.NoError(t, err)
+	}
+
+	const redemptions = 10
+	var mu sync.Mutex
+	var counts []int
+	var wg sync.WaitGroup
+	for i := 0; i < redemptions; i++ {
+		wg.Add(1)
+		go func(store replayStore) {
+			defer wg.Done()
+			uses, err := store.redeem(context.Background(), "shared", time.Now().Add(time.Hour))
+			assert.NoError(t, err)
+			mu.Lock()
+			counts = append(counts, uses)
+			mu.Unlock()
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+
+	sort.Ints(counts)
+	expected := make([]int, redemptions)
+	for i := range expected {
+		expected[i] = i + 1
+	}
+	assert.Equal(t, expected, counts, "replicas should never hand out the same count twice")
+
+	err = checkReplay(context.Background(), replicas[0], 1, "fresh", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	err = checkReplay(context.Background(), replicas[1], 1, "fresh", time.Now().Add(time.Hour))
+	assert.ErrorIs(t, err, errTokenReplayed, "a token used on one replica is rejected on another")
+}
+
+func TestValidateReplay(t *testing.T) {
+	config := &Config{
+		Replay: ReplayConfig{Enabled: true, Backend: ReplayBackendNatsKV},
+		Idp:    []Idp{{Description: "sso"}},
+	}
+	assert.NoError(t, config.validateReplay(), "the default ttl should cover the default token lifetime")
+
+	config.Replay.TTL = Duration{time.Hour}
+	assert.ErrorContains(t, config.validateReplay(), "shorter than the max_token_lifetime plus clock_skew of idp sso")
+
+	config.Idp[0].MaxTokenLifetime = Duration{50 * time.Minute}
+	config.Idp[0].ClockSkew = Duration{time.Minute}
+	assert.NoError(t, config.validateReplay())
+
+	config.Idp = append(config.Idp, Idp{Description: "long-lived", MaxTokenLifetime: Duration{2 * time.Hour}})
+	assert.Error(t, config.validateReplay())
+
+	config.Replay.Backend = ReplayBackendMemory
+	assert.NoError(t, config.validateReplay(), "memory entries expire with their tokens")
+}
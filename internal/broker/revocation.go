@@ -0,0 +1,224 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/goccy/go-yaml"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+)
+
+// Reasons reported when a request is denied by the revocation list.
+const (
+	RevocationReasonJwtID         = "jti"
+	RevocationReasonIssuerSubject = "issuer_subject"
+	RevocationReasonSubject       = "sub"
+	RevocationReasonEmail         = "email"
+)
+
+var errIdentityRevoked = errors.New("identity has been revoked")
+
+// revocationEntry denies every identity matching all of its non-empty fields.
+type revocationEntry struct {
+	Issuer  string `yaml:"iss" json:"iss"`
+	Subject string `yaml:"sub" json:"sub"`
+	Email   string `yaml:"email" json:"email"`
+	JwtID   string `yaml:"jti" json:"jti"`
+}
+
+func (e revocationEntry) validate() error {
+	if e.Subject == "" && e.Email == "" && e.JwtID == "" {
+		return errors.New("revocation entry needs at least one of sub, email or jti")
+	}
+	return nil
+}
+
+// matches reports whether the entry denies the identity, and the reason.
+func (e revocationEntry) matches(issuer string, claims *IdpJwtClaims) (string, bool) {
+	if (e.Issuer != "" && e.Issuer != issuer) ||
+		(e.Subject != "" && e.Subject != claims.Subject) ||
+		(e.Email != "" && e.Email != claims.Email) ||
+		(e.JwtID != "" && e.JwtID != claims.JwtID) {
+		return "", false
+	}
+
+	switch {
+	case e.JwtID != "":
+		return RevocationReasonJwtID, true
+	case e.Issuer != "" && e.Subject != "":
+		return RevocationReasonIssuerSubject, true
+	case e.Subject != "":
+		return RevocationReasonSubject, true
+	default:
+		return RevocationReasonEmail, true
+	}
+}
+
+// revocationList is a set of revocation entries keyed by where they came
+// from: the position in a file, or the key in a KV bucket.
+type revocationList struct {
+	mu      sync.RWMutex
+	entries map[string]revocationEntry
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{entries: make(map[string]revocationEntry)}
+}
+
+func (l *revocationList) set(key string, entry revocationEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[key] = entry
+}
+
+func (l *revocationList) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// check returns the reason the identity is revoked, if it is.
+func (l *revocationList) check(issuer string, claims *IdpJwtClaims) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, entry := range l.entries {
+		if reason, ok := entry.matches(issuer, claims); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// checkRevocations returns the reason the identity is revoked by any of
+// lists. Nil lists are skipped.
+func checkRevocations(lists []*revocationList, issuer string, claims *IdpJwtClaims) (string, bool) {
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		if reason, ok := list.check(issuer, claims); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// loadRevocationFile reads a YAML or JSON list of revocation entries. It
+// returns nil if path is empty.
+func loadRevocationFile(path string) (*revocationList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading revocation file: %w", err)
+	}
+
+	var entries []revocationEntry
+	if err := yaml.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing revocation file %s: %w", path, err)
+	}
+
+	list := newRevocationList()
+	for i, entry := range entries {
+		if err := entry.validate(); err != nil {
+			return nil, fmt.Errorf("revocation file %s entry %d: %w", path, i, err)
+		}
+		list.set(strconv.Itoa(i), entry)
+	}
+	return list, nil
+}
+
+// watchRevocationBucket loads revocation entries from a JetStream KV bucket,
+// creating it if needed, and keeps them up to date until ctx is cancelled.
+// Each key holds one JSON encoded entry. It returns once the current entries
+// have been loaded, so no revoked identity is accepted at startup.
+func watchRevocationBucket(ctx context.Context, nc *nats.Conn, bucket string) (*revocationList, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("error creating jetstream context: %w", err)
+	}
+
+	setupCtx, setupCancel := context.WithTimeout(ctx, kvOperationTimeout)
+	defer setupCancel()
+
+	kv, err := js.KeyValue(setupCtx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(setupCtx, jetstream.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "nats-iam-broker revoked identities",
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening revocation kv bucket %s: %w", bucket, err)
+	}
+
+	watcher, err := kv.WatchAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error watching revocation kv bucket %s: %w", bucket, err)
+	}
+
+	list := newRevocationList()
+	apply := func(update jetstream.KeyValueEntry) {
+		if update.Operation() != jetstream.KeyValuePut {
+			list.remove(update.Key())
+			return
+		}
+		var entry revocationEntry
+		err := json.Unmarshal(update.Value(), &entry)
+		if err == nil {
+			err = entry.validate()
+		}
+		if err != nil {
+			zap.L().Warn("ignoring invalid revocation entry", zap.String("bucket", bucket), zap.String("key", update.Key()), zap.Error(err))
+			list.remove(update.Key())
+			return
+		}
+		list.set(update.Key(), entry)
+	}
+
+	// The watcher sends the current entries, then nil once it is caught up.
+	initialCtx, initialCancel := context.WithTimeout(ctx, kvOperationTimeout)
+	defer initialCancel()
+	for caughtUp := false; !caughtUp; {
+		select {
+		case update := <-watcher.Updates():
+			if update == nil {
+				caughtUp = true
+				continue
+			}
+			apply(update)
+		case <-initialCtx.Done():
+			_ = watcher.Stop()
+			return nil, fmt.Errorf("timed out loading revocation kv bucket %s", bucket)
+		}
+	}
+
+	go func() {
+		defer func() { _ = watcher.Stop() }()
+		for {
+			select {
+			case update, ok := <-watcher.Updates():
+				if !ok {
+					return
+				}
+				if update != nil {
+					apply(update)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	zap.L().Info("watching revocation kv bucket", zap.String("bucket", bucket))
+	return list, nil
+}
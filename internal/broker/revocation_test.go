@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/nats-io/jwt/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationEntry_Matches(t *testing.T) {
+	claims := &IdpJwtClaims{Subject: "alice", Email: "alice@example.com", JwtID: "jti-1"}
+	const issuer = "https://idp.example.com"
+
+	testCases := []struct {
+		name       string
+		entry      revocationEntry
+		wantReason string
+	}{
+		{name: "subject", entry: revocationEntry{Subject: "alice"}, wantReason: RevocationReasonSubject},
+		{name: "email", entry: revocationEntry{Email: "alice@example.com"}, wantReason: RevocationReasonEmail},
+		{name: "jti", entry: revocationEntry{JwtID: "jti-1"}, wantReason: RevocationReasonJwtID},
+		{name: "issuer and subject", entry: revocationEntry{Issuer: issuer, Subject: "alice"}, wantReason: RevocationReasonIssuerSubject},
+		{name: "same subject at another issuer", entry: revocationEntry{Issuer: "https://other", Subject: "alice"}},
+		{name: "other subject", entry: revocationEntry{Subject: "bob"}},
+		{name: "all fields must match", entry: revocationEntry{Subject: "alice", Email: "bob@example.com"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, ok := tc.entry.matches(issuer, claims)
+			assert.Equal(t, tc.wantReason != "", ok)
+			assert.Equal(t, tc.wantReason, reason)
+		})
+	}
+}
+
+func TestLoadRevocationFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("unset", func(t *testing.T) {
+		list, err := loadRevocationFile("")
+		require.NoError(t, err)
+		assert.Nil(t, list)
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		path := filepath.Join(dir, "revoked.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("- email: mallory@example.com\n- iss: https://idp\n  sub: eve\n"), 0644))
+
+		list, err := loadRevocationFile(path)
+		require.NoError(t, err)
+
+		reason, ok := checkRevocations([]*revocationList{nil, list}, "https://idp", &IdpJwtClaims{Subject: "eve"})
+		assert.True(t, ok)
+		assert.Equal(t, RevocationReasonIssuerSubject, reason)
+		_, ok = checkRevocations([]*revocationList{list}, "https://idp", &IdpJwtClaims{Subject: "alice"})
+		assert.False(t, ok)
+	})
+
+	t.Run("entry without identity", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("- iss: https://idp\n"), 0644))
+
+		_, err := loadRevocationFile(path)
+		assert.ErrorContains(t, err, "entry 0")
+	})
+}
+
+func TestWatchRevocationBucket(t *testing.T) {
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	require.NoError(t, err)
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server failed to start")
+	}
+	defer ns.Shutdown()
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "revoked"})
+	require.NoError(t, err)
+	_, err = kv.PutString(ctx, "incident-1", `{"sub":"eve"}`)
+	require.NoError(t, err)
+
+	list, err := watchRevocationBucket(ctx, nc, "revoked")
+	require.NoError(t, err)
+
+	revoked := func(sub string) bool {
+		_, ok := list.check("https://idp", &IdpJwtClaims{Subject: sub})
+		return ok
+	}
+	assert.True(t, revoked("eve"), "existing entries are loaded before returning")
+
+	_, err = kv.PutString(ctx, "incident-2", `{"sub":"mallory"}`)
+	require.NoError(t, err)
+	_, err = kv.PutString(ctx, "garbage", `not json`)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return revoked("mallory") }, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, revoked("alice"), "invalid entries should be ignored")
+
+	require.NoError(t, kv.Delete(ctx, "incident-1"))
+	assert.Eventually(t, func() bool { return !revoked("eve") }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestHandleAuthRequest_RevocationIgnoresTransforms(t *testing.T) {
+	signer := newTestSigner(t, "k1")
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&signer.key.PublicKey}}
+	verifier := NewStaticJwtVerifier(NewServerContext(nil), []string{"nats"}, "https://idp.example.com", keySet, 0, 0, nil)
+	transforms, err := compileClaimTransforms([]ClaimTransform{{Claim: "sub", Map: map[string]string{"alice": "someone-else"}}})
+	require.NoError(t, err)
+	verifier.transforms = transforms
+	verifiers := []IdpAndJwtVerifier{{verifier, &Idp{Description: "sso", IssuerURL: "https://idp.example.com", ClientID: "nats"}}}
+
+	list := newRevocationList()
+	list.entries["0"] = revocationEntry{Subject: "alice"}
+
+	request := &jwt.AuthorizationRequestClaims{}
+	request.ConnectOptions.Token = signer.mint(t, map[string]interface{}{"iss": "https://idp.example.com", "aud": "nats", "sub": "alice"})
+
+	_, _, _, err = handleAuthRequest(context.Background(), NewServerContext(nil), nil, nil, &Config{}, nil, verifiers, "", nil,
+		[]*revocationList{list}, nil, request)
+	assert.ErrorIs(t, err, errIdentityRevoked, "a transform must not hide a revoked subject")
+}
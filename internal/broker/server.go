@@ -96,6 +96,7 @@ func StartWithContext(ctx context.Context, configFiles []string, cliOpts *Option
 	var health *metrics.HealthChecker
 	if serverOpts.MetricsEnabled {
 		m = metrics.New()
+		srvCtx.Metrics = m
 		health = metrics.NewHealthChecker()
 		metricsServer := metrics.NewServer(serverOpts.MetricsPort, health)
 		metricsServer.Start()
@@ -159,28 +160,42 @@ func StartWithContext(ctx context.Context, configFiles []string, cliOpts *Option
 		health.SetNATSConn(nc)
 	}
 
-	idpVerifiers, err := NewIdpVerifiers(srvCtx, config)
+	idpVerifiers, pendingIdps, err := newIdpVerifierSet(srvCtx, config)
 	if err != nil {
 		return err
 	}
 
-	if health != nil {
-		health.SetIDPVerifiersReady(len(idpVerifiers) > 0)
-	}
-
 	auditEventSubject := config.Service.Name + ".evt.audit.account.%s.user.%s.created"
 	//nolint:mnd // 2 is the number of %s placeholders in auditEventSubject
 	zap.L().Info("audit events configured", zap.String("subject_pattern", strings.Replace(auditEventSubject, "%s", "*", 2)))
 
+	revocations, err := loadRevocationFile(config.Revocation.File)
+	if err != nil {
+		return err
+	}
+
+	directory, err := loadDirectoryFile(config.Directory.File)
+	if err != nil {
+		return err
+	}
+
 	// Build initial live state and config watcher
 	initial := &LiveState{
 		config:        config,
 		configManager: configManager,
 		idpVerifiers:  idpVerifiers,
+		pendingIdps:   pendingIdps,
 		auditSubject:  auditEventSubject,
+		revocations:   revocations,
+		directory:     directory,
 	}
 	watcher := NewConfigWatcher(srvCtx, configFiles, initial)
 
+	// Keep retrying IDPs that failed setup, and report per-IDP state
+	supervisor := NewIdpSupervisor(srvCtx, watcher, m, health)
+	supervisor.Start()
+	defer supervisor.Stop()
+
 	if serverOpts.WatchConfig {
 		if err := watcher.Start(); err != nil {
 			zap.L().Warn("failed to start config watcher, continuing without hot-reload", zap.Error(err))
@@ -189,7 +204,20 @@ func StartWithContext(ctx context.Context, configFiles []string, cliOpts *Option
 		}
 	}
 
-	authCallback := newAuthCallbackWithWatcher(srvCtx, m, nc, watcher)
+	replay, err := newReplayStore(ctx, config.Replay, nc)
+	if err != nil {
+		return err
+	}
+
+	var bucketRevocations *revocationList
+	if config.Revocation.Bucket != "" {
+		bucketRevocations, err = watchRevocationBucket(ctx, nc, config.Revocation.Bucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	authCallback := newAuthCallbackWithWatcher(srvCtx, m, nc, watcher, replay, bucketRevocations)
 	auth := NewAuthService(srvCtx, config.Service.Account.SigningNKey.KeyPair, config.serviceEncryptionXkey(), authCallback, m)
 
 	zap.L().Info("starting service", zap.String("version", effectiveVersion))
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultTTLCacheMaxEntries = 10000
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// ttlCache is a concurrency-safe map whose entries expire at a per-entry time.
+// When full, expired entries are swept before an arbitrary entry is evicted.
+type ttlCache[V any] struct {
+	mu         sync.Mutex
+	entries    map[string]ttlCacheEntry[V]
+	maxEntries int
+	now        func() time.Time
+}
+
+func newTTLCache[V any](maxEntries int) *ttlCache[V] {
+	if maxEntries <= 0 {
+		maxEntries = defaultTTLCacheMaxEntries
+	}
+	return &ttlCache[V]{
+		entries:    make(map[string]ttlCacheEntry[V]),
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// get returns the value stored for key, if present and not yet expired.
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// set stores value under key until expiresAt. Entries that are already
+// expired are not stored.
+func (c *ttlCache[V]) set(key string, value V, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(expiresAt) {
+		return
+	}
+
+	if !c.hasRoom(key, now) {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: expiresAt}
+}
+
+// trySet stores value under key until expiresAt like set, but never evicts an
+// unexpired entry to make room. It reports false when the cache is full.
+func (c *ttlCache[V]) trySet(key string, value V, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(expiresAt) {
+		return true
+	}
+	if !c.hasRoom(key, now) {
+		return false
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: expiresAt}
+	return true
+}
+
+// hasRoom reports whether key can be stored without evicting an unexpired
+// entry, sweeping expired entries if the cache is full. c.mu must be held.
+func (c *ttlCache[V]) hasRoom(key string, now time.Time) bool {
+	if _, exists := c.entries[key]; exists || len(c.entries) < c.maxEntries {
+		return true
+	}
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	return len(c.entries) < c.maxEntries
+}
+
+// len returns the number of stored entries, including expired ones not yet swept.
+func (c *ttlCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cache := newTTLCache[string](2)
+	cache.now = func() time.Time { return now }
+
+	t.Run("get before and after expiry", func(t *testing.T) {
+		cache.set("a", "alpha", now.Add(time.Minute))
+		v, ok := cache.get("a")
+		assert.True(t, ok)
+		assert.Equal(t, "alpha", v)
+
+		now = now.Add(2 * time.Minute)
+		_, ok = cache.get("a")
+		assert.False(t, ok)
+		assert.Equal(t, 0, cache.len())
+	})
+
+	t.Run("expired entries are not stored", func(t *testing.T) {
+		cache.set("b", "beta", now.Add(-time.Second))
+		_, ok := cache.get("b")
+		assert.False(t, ok)
+	})
+
+	t.Run("bounded size", func(t *testing.T) {
+		cache.set("c", "gamma", now.Add(time.Minute))
+		cache.set("d", "delta", now.Add(time.Second))
+		now = now.Add(2 * time.Second)
+
+		// "d" has expired, so it is swept in favour of "e"
+		cache.set("e", "epsilon", now.Add(time.Minute))
+		assert.Equal(t, 2, cache.len())
+		_, ok := cache.get("c")
+		assert.True(t, ok)
+		_, ok = cache.get("e")
+		assert.True(t, ok)
+
+		cache.set("f", "phi", now.Add(time.Minute))
+		assert.Equal(t, 2, cache.len())
+	})
+
+	t.Run("trySet never evicts live entries", func(t *testing.T) {
+		cache := newTTLCache[string](1)
+		cache.now = func() time.Time { return now }
+
+		assert.True(t, cache.trySet("a", "alpha", now.Add(time.Minute)))
+		assert.True(t, cache.trySet("a", "alpha-2", now.Add(time.Minute)), "existing keys can be updated")
+		assert.False(t, cache.trySet("b", "beta", now.Add(time.Minute)))
+		v, _ := cache.get("a")
+		assert.Equal(t, "alpha-2", v)
+
+		now = now.Add(2 * time.Minute)
+		assert.True(t, cache.trySet("b", "beta", now.Add(time.Minute)), "expired entries make room")
+	})
+}
@@ -3,6 +3,7 @@ package metrics
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 	"sync/atomic"
 
 	"github.com/nats-io/nats.go"
@@ -15,6 +16,9 @@ type HealthChecker struct {
 	natsConnected     atomic.Bool
 	idpVerifiersReady atomic.Bool
 	serviceRegistered atomic.Bool
+
+	idpStatesMu sync.RWMutex
+	idpStates   map[string]string
 }
 
 // NewHealthChecker creates a new HealthChecker.
@@ -44,6 +48,29 @@ func (h *HealthChecker) SetServiceRegistered(registered bool) {
 	h.serviceRegistered.Store(registered)
 }
 
+// SetIDPStates replaces the reported setup state of every configured IDP,
+// keyed by IDP description (e.g. "active", "pending", "failing").
+func (h *HealthChecker) SetIDPStates(states map[string]string) {
+	copied := make(map[string]string, len(states))
+	for idp, state := range states {
+		copied[idp] = state
+	}
+
+	h.idpStatesMu.Lock()
+	defer h.idpStatesMu.Unlock()
+	h.idpStates = copied
+}
+
+// SetIDPState updates the reported setup state of a single IDP.
+func (h *HealthChecker) SetIDPState(idp string, state string) {
+	h.idpStatesMu.Lock()
+	defer h.idpStatesMu.Unlock()
+	if h.idpStates == nil {
+		h.idpStates = make(map[string]string)
+	}
+	h.idpStates[idp] = state
+}
+
 // healthStatus is the JSON response for health endpoints.
 type healthStatus struct {
 	Status string            `json:"status"`
@@ -86,6 +113,13 @@ func (h *HealthChecker) IsReady() (bool, map[string]string) {
 		checks["service"] = "not_registered"
 	}
 
+	// Per-IDP states are informational; readiness only requires one verifier.
+	h.idpStatesMu.RLock()
+	for idp, state := range h.idpStates {
+		checks["idp:"+idp] = state
+	}
+	h.idpStatesMu.RUnlock()
+
 	return natsOK && idpOK && svcOK, checks
 }
 
@@ -161,3 +161,30 @@ func TestReadinessHandler_OK(t *testing.T) {
 		t.Errorf("expected 3 checks, got %d", len(body.Checks))
 	}
 }
+
+func TestHealthChecker_IDPStates(t *testing.T) {
+	h := NewHealthChecker()
+	h.SetNATSConnected(true)
+	h.SetIDPVerifiersReady(true)
+	h.SetServiceRegistered(true)
+
+	h.SetIDPStates(map[string]string{"primary": "active", "secondary": "pending"})
+	h.SetIDPState("secondary", "failing")
+
+	ready, checks := h.IsReady()
+	if !ready {
+		t.Error("expected ready=true while at least one IDP is active")
+	}
+	if checks["idp:primary"] != "active" {
+		t.Errorf("expected idp:primary=active, got %s", checks["idp:primary"])
+	}
+	if checks["idp:secondary"] != "failing" {
+		t.Errorf("expected idp:secondary=failing, got %s", checks["idp:secondary"])
+	}
+
+	h.SetIDPStates(map[string]string{"primary": "active"})
+	_, checks = h.IsReady()
+	if _, ok := checks["idp:secondary"]; ok {
+		t.Error("expected idp:secondary to be removed after states were replaced")
+	}
+}
@@ -15,33 +15,75 @@ const (
 	namespace = "nats_iam_broker"
 
 	// Label names
-	labelStatus  = "status"
-	labelAccount = "account"
-	labelIDP     = "idp"
-	labelStage   = "stage"
+	labelStatus     = "status"
+	labelAccount    = "account"
+	labelIDP        = "idp"
+	labelStage      = "stage"
+	labelState      = "state"
+	labelResult     = "result"
+	labelReason     = "reason"
+	labelEnrichment = "enrichment"
 
 	// Status values
 	StatusSuccess = "success"
 	StatusError   = "error"
 	StatusDenied  = "denied"
+	StatusRevoked = "revoked"
 
 	// Stage values for request errors
 	StageDecrypt = "decrypt"
 	StageDecode  = "decode"
 	StageSign    = "sign"
 	StageEncrypt = "encrypt"
+
+	// Result values for password grant and token refresh attempts, alongside
+	// success and error
+	ResultInvalidCredentials = "invalid_credentials"
+	ResultRateLimited        = "rate_limited"
+	ResultInvalidGrant       = "invalid_grant"
+	ResultRotated            = "rotated"
+
+	// Result values for JWKS lookups of unknown key IDs
+	ResultRefreshed = "refreshed"
+
+	// Result values for cache lookups
+	ResultHit   = "hit"
+	ResultMiss  = "miss"
+	ResultStale = "stale"
+
+	// IDP setup states
+	IDPStateActive  = "active"
+	IDPStatePending = "pending"
+	IDPStateFailing = "failing"
 )
 
+// IDPStates lists every IDP setup state, used to zero the other states when
+// one is set.
+var IDPStates = []string{IDPStateActive, IDPStatePending, IDPStateFailing}
+
 // Metrics holds all prometheus metrics for the broker.
 type Metrics struct {
-	AuthRequestsTotal    *prometheus.CounterVec
-	AuthRequestDuration  *prometheus.HistogramVec
-	AuthRequestsInFlight prometheus.Gauge
-	TokensMinted         *prometheus.CounterVec
-	IDPVerifyTotal       *prometheus.CounterVec
-	IDPVerifyDuration    *prometheus.HistogramVec
-	RequestErrors        *prometheus.CounterVec
-	ResponseErrors       *prometheus.CounterVec
+	AuthRequestsTotal     *prometheus.CounterVec
+	AuthRequestDuration   *prometheus.HistogramVec
+	AuthRequestsInFlight  prometheus.Gauge
+	TokensMinted          *prometheus.CounterVec
+	IDPVerifyTotal        *prometheus.CounterVec
+	IDPVerifyDuration     *prometheus.HistogramVec
+	RequestErrors         *prometheus.CounterVec
+	ResponseErrors        *prometheus.CounterVec
+	IDPState              *prometheus.GaugeVec
+	IDPSetupAttempts      *prometheus.CounterVec
+	PasswordGrantAttempts *prometheus.CounterVec
+	TokenRefreshAttempts  *prometheus.CounterVec
+	RevokedRequests       *prometheus.CounterVec
+	JwksFetches           *prometheus.CounterVec
+	JwksKeys              *prometheus.GaugeVec
+	JwksLastRefresh       *prometheus.GaugeVec
+	JwksKeyMisses         *prometheus.CounterVec
+	UserInfoCacheRequests *prometheus.CounterVec
+	EnrichmentRequests    *prometheus.CounterVec
+	EnrichmentDuration    *prometheus.HistogramVec
+	DistributedClaims     *prometheus.CounterVec
 }
 
 // New creates and registers all prometheus metrics.
@@ -112,6 +154,111 @@ func New() *Metrics {
 			},
 			[]string{labelStage},
 		),
+		IDPState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "idp_state",
+				Help:      "Setup state of each IDP (1 for the current state, 0 otherwise).",
+			},
+			[]string{labelIDP, labelState},
+		),
+		IDPSetupAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "idp_setup_attempts_total",
+				Help:      "Total number of background IDP setup retries.",
+			},
+			[]string{labelIDP, labelStatus},
+		),
+		PasswordGrantAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "password_grant_attempts_total",
+				Help:      "Total number of password grant exchanges, by IDP and result.",
+			},
+			[]string{labelIDP, labelResult},
+		),
+		TokenRefreshAttempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "token_refresh_attempts_total",
+				Help:      "Total number of refresh token redemptions for expired ID tokens, by IDP and result.",
+			},
+			[]string{labelIDP, labelResult},
+		),
+		RevokedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "revoked_requests_total",
+				Help:      "Total number of auth requests denied by the revocation list, by IDP and the matching field.",
+			},
+			[]string{labelIDP, labelReason},
+		),
+		JwksFetches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "jwks_fetch_total",
+				Help:      "Total number of JWKS fetches, by IDP and status.",
+			},
+			[]string{labelIDP, labelStatus},
+		),
+		JwksKeys: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "jwks_keys",
+				Help:      "Number of signing keys in each IDP's last fetched JWKS.",
+			},
+			[]string{labelIDP},
+		),
+		JwksLastRefresh: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "jwks_last_refresh_timestamp_seconds",
+				Help:      "Unix time of each IDP's last successful JWKS fetch.",
+			},
+			[]string{labelIDP},
+		),
+		JwksKeyMisses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "jwks_key_misses_total",
+				Help:      "Total number of tokens signed with an unknown key ID, by IDP and whether the JWKS was refreshed or rate limited.",
+			},
+			[]string{labelIDP, labelResult},
+		),
+		UserInfoCacheRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "userinfo_cache_requests_total",
+				Help:      "Total number of UserInfo cache lookups, by IDP and result (hit, stale, miss).",
+			},
+			[]string{labelIDP, labelResult},
+		),
+		EnrichmentRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "enrichment_requests_total",
+				Help:      "Total number of claims enrichment lookups, by IDP, enrichment name and result (success, error, hit).",
+			},
+			[]string{labelIDP, labelEnrichment, labelResult},
+		),
+		EnrichmentDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "enrichment_duration_seconds",
+				Help:      "Duration of claims enrichment lookups that were not served from the cache, in seconds.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{labelIDP, labelEnrichment},
+		),
+		DistributedClaims: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "distributed_claims_requests_total",
+				Help:      "Total number of aggregated and distributed claim sources resolved, by IDP and status (success, error).",
+			},
+			[]string{labelIDP, labelStatus},
+		),
 	}
 
 	prometheus.MustRegister(
@@ -123,11 +270,35 @@ func New() *Metrics {
 		m.IDPVerifyDuration,
 		m.RequestErrors,
 		m.ResponseErrors,
+		m.IDPState,
+		m.IDPSetupAttempts,
+		m.PasswordGrantAttempts,
+		m.TokenRefreshAttempts,
+		m.RevokedRequests,
+		m.JwksFetches,
+		m.JwksKeys,
+		m.JwksLastRefresh,
+		m.JwksKeyMisses,
+		m.UserInfoCacheRequests,
+		m.EnrichmentRequests,
+		m.EnrichmentDuration,
+		m.DistributedClaims,
 	)
 
 	return m
 }
 
+// SetIDPState marks state as the current setup state of an IDP.
+func (m *Metrics) SetIDPState(idp string, state string) {
+	for _, s := range IDPStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.IDPState.WithLabelValues(idp, s).Set(value)
+	}
+}
+
 // Server runs an HTTP server that exposes the /metrics endpoint.
 type Server struct {
 	httpServer *http.Server
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,6 +31,19 @@ func TestNew(t *testing.T) {
 	assert.NotNil(t, m.IDPVerifyDuration)
 	assert.NotNil(t, m.RequestErrors)
 	assert.NotNil(t, m.ResponseErrors)
+	assert.NotNil(t, m.IDPState)
+	assert.NotNil(t, m.IDPSetupAttempts)
+	assert.NotNil(t, m.PasswordGrantAttempts)
+	assert.NotNil(t, m.TokenRefreshAttempts)
+	assert.NotNil(t, m.RevokedRequests)
+	assert.NotNil(t, m.JwksFetches)
+	assert.NotNil(t, m.JwksKeys)
+	assert.NotNil(t, m.JwksLastRefresh)
+	assert.NotNil(t, m.JwksKeyMisses)
+	assert.NotNil(t, m.UserInfoCacheRequests)
+	assert.NotNil(t, m.EnrichmentRequests)
+	assert.NotNil(t, m.EnrichmentDuration)
+	assert.NotNil(t, m.DistributedClaims)
 
 	// Verify metrics can be incremented without panicking
 	m.AuthRequestsTotal.WithLabelValues(StatusSuccess).Inc()
@@ -40,6 +54,12 @@ func TestNew(t *testing.T) {
 	m.IDPVerifyDuration.WithLabelValues("idp1").Observe(0.1)
 	m.RequestErrors.WithLabelValues(StageDecrypt).Inc()
 	m.ResponseErrors.WithLabelValues(StageSign).Inc()
+	m.IDPSetupAttempts.WithLabelValues("idp1", StatusError).Inc()
+
+	m.SetIDPState("idp1", IDPStateFailing)
+	m.SetIDPState("idp1", IDPStateActive)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.IDPState.WithLabelValues("idp1", IDPStateActive)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.IDPState.WithLabelValues("idp1", IDPStateFailing)))
 }
 
 func TestNewServer(t *testing.T) {